@@ -1,21 +1,43 @@
 import { Construct } from "constructs";
 import { HarborConstruct } from "./HarborConstruct";
-import { ITask } from "./Task";
+import { ITask, TaskPolicyOpts } from "./Task";
 
-// Options for the exec command construct
-type ExecCommandOpts = {
+// What the exec command runs, either an executable or a shell script.
+type ExecCommandTarget = {
 	// The executable to execute. 
 	executable: string;
 	// The arguments to pass to the executable
 	args: string[];
+} | {
+	// A script run with `/bin/sh -c`, it stops at the first command that fails.
+	shell: string;
+	// The positional parameters of the script, `$1` and on.
+	args?: string[];
+}
+
+// Options for the exec command construct
+type ExecCommandOpts = TaskPolicyOpts & ExecCommandTarget & {
+	// The directory to run in, relative to the package root. Defaults to the package root.
+	cwd?: string;
 	// Any environment variables you want to pass to the executable. 
+	// Values may reference `${PACKAGE_ROOT}`, `${HARBOR_CACHE}` and variables set before them.
 	env?: Record<string, string> | typeof process.env;
-	// Not used currently
+	// .env files, relative to the package root, loaded in order before `env`.
+	envFiles?: string[];
+	// Start from an empty environment instead of harbor's, keeping only PATH, HOME and the variables in `passEnv`.
+	cleanEnv?: boolean;
+	passEnv?: string[];
+	// Variables whose values are kept out of the cache key, like tokens. Set them with `envFiles` or interpolation, not literal values.
+	secrets?: string[];
+	// Globs, relative to the package root, of the files this command reads. Their contents are part of the cache key so editing them causes a re-run.
 	inputs?: string[]
+	// Files and directories, relative to the package root, this command produces. They are restored from the cache when the command is replayed.
+	artifacts?: string[]
 }
 
 /**
  * This is a simple executor that just calls `os.Exec` on your machine. This is not the same as a bash script or other such shell script, this literally calls `exec` on what ever the executable is.
+ * Set `shell` instead of `executable` to run a script through `/bin/sh`. Commands run in the package root unless `cwd` says otherwise.
  */
 export class ExecCommand extends HarborConstruct implements ITask {
 	constructor(scope: Construct, public readonly id: string, opts: ExecCommandOpts) {
@@ -2,7 +2,57 @@ import { Construct, IConstruct } from "constructs";
 import { HarborConstruct } from "./HarborConstruct";
 import { Dependency } from "./Dependency";
 
-export type TaskOpts = {
+// How long to wait between the retries of a failed task. The wait starts at `delay` and is multiplied by `factor` after every retry, up to `maxDelay`.
+export type Backoff = {
+	// The wait before the first retry, as a duration like "500ms" or a number of seconds. Defaults to 1s.
+	delay?: string | number;
+	// What the wait is multiplied by after every retry. Defaults to 2.
+	factor?: number;
+	// The longest wait between two retries. Defaults to 1m.
+	maxDelay?: string | number;
+}
+
+// A resource a task holds while it runs. A name takes one unit of the resource, a weight takes that many.
+export type Lock = string | {
+	name: string;
+	weight?: number;
+}
+
+// Options every task accepts, whatever its kind. They are enforced by harbor itself and are not part of the task's cache key.
+export type TaskPolicyOpts = {
+	// How long the task may run before it is cancelled, as a duration like "90s" or "5m" or a number of seconds.
+	timeout?: string | number;
+	// How many more times to run the task when it fails. Only the task is run again, not its dependencies.
+	retries?: number;
+	// How long to wait between retries.
+	backoff?: Backoff;
+	// Lets the tasks that need this one run even when it fails. The failure is still reported at the end of the run.
+	allowFailure?: boolean;
+	// Resources the task holds while it runs, like a port it binds. Tasks sharing a resource never run at the same time, unless the package declares the resource with more units using `pkg.resource`.
+	locks?: Lock[];
+	// Tasks with a higher priority start first when more tasks are ready than there are jobs. Defaults to 0.
+	priority?: number;
+}
+
+function policyOptions(opts: TaskPolicyOpts): TaskPolicyOpts {
+	const policy: TaskPolicyOpts = {
+		timeout: opts.timeout,
+		retries: opts.retries,
+		backoff: opts.backoff,
+		allowFailure: opts.allowFailure,
+		locks: opts.locks,
+		priority: opts.priority,
+	};
+	// Options that aren't set are left out, they would override the ones given through `options`.
+	(Object.keys(policy) as (keyof TaskPolicyOpts)[]).forEach(key => {
+		if (policy[key] === undefined) {
+			delete policy[key];
+		}
+	});
+	return policy;
+}
+
+export type TaskOpts = TaskPolicyOpts & {
 	plugin: IConstruct;
 	name?: string;
 	options: any;
@@ -28,6 +78,7 @@ export class Task extends HarborConstruct implements ITask{
 			options: {
 				plugin: opts.plugin.node.id,
 				...opts.options,
+				...policyOptions(opts),
 				artifacts: opts.artifacts,
 				inputs,
 			},
@@ -51,7 +102,7 @@ export class Task extends HarborConstruct implements ITask{
 	}
 }
 
-export type RemoteTaskOpts = {
+export type RemoteTaskOpts = TaskPolicyOpts & {
 	dependency: Dependency;
 	taskName: string;
 	name?: string;
@@ -74,6 +125,7 @@ export class RemoteTask extends HarborConstruct implements ITask{
 				dependency: opts.dependency.options,
 				run: opts.taskName,
 				...opts.options,
+				...policyOptions(opts),
 				artifacts: opts.artifacts,
 				inputs,
 				isDepenedencyLocal: opts.isDepenedencyLocal
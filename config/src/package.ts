@@ -31,6 +31,8 @@ const PackageOptions = z.object({
 	version: z.string().optional(),
 	stability: z.enum(["Beta", "Generally Available", "End of Life", "Alpha", "Pre-Alpha"]).optional(),
 	artifactsLocation: z.string().url().optional(),
+	// The environment every command of the package starts with, commands' own env overrides it.
+	env: z.record(z.string()).optional(),
 });
 
 export type PackageOptions = z.infer<typeof PackageOptions>
@@ -50,6 +52,33 @@ class RemoteExecutorPlugin extends HarborConstruct {
 	}
 }
 
+// The types a parameter can have, and the values they are read as.
+type ParamTypes = {
+	string: string;
+	number: number;
+	boolean: boolean;
+}
+
+// A parameter runs of the package can be given with `harbor run --param name=value`.
+export type ParamOptions<T extends keyof ParamTypes> = {
+	type: T;
+	// What the parameter is used for.
+	description?: string;
+	// The value used when the parameter is not given.
+	default?: ParamTypes[T];
+	// The only values the parameter may have.
+	choices?: ParamTypes[T][];
+}
+
+// The parameters of the current run, harbor passes them as a JSON object of strings.
+function givenParams(): Record<string, string> {
+	try {
+		return JSON.parse(process.env.HARBOR_PARAMS ?? "{}");
+	} catch {
+		return {};
+	}
+}
+
 const pkgSymbol = Symbol.for("Package");
 
 export class Package extends Construct {
@@ -58,6 +87,8 @@ export class Package extends Construct {
 	public readonly location: string;
 	private readonly tasks: Record<string, string> = {};
 	private readonly setup: string[] = [];
+	private readonly params: Record<string, ParamOptions<keyof ParamTypes>> = {};
+	private readonly resources: Record<string, number> = {};
 	public readonly packageInfo: Omit<PackageOptions, "meta">
 	public readonly remoteExcecutor: IConstruct;
 
@@ -118,6 +149,34 @@ export class Package extends Construct {
 		this.setup.push(node.path);
 	}
 
+	/**
+	 * resource declares how many units of a resource tasks may hold at the same time, like at most 2 heavy compile jobs.
+	 * Resources that aren't declared have a single unit.
+	 */
+	public resource(name: string, capacity: number) {
+		this.resources[name] = capacity;
+	}
+
+	/**
+	 * param declares a parameter of the package and returns its value for the current run. Harbor checks the values given to
+	 * `harbor run --param` against the declaration, and parameters are part of the cache key of every task.
+	 */
+	public param<T extends keyof ParamTypes>(name: string, opts: ParamOptions<T>): ParamTypes[T] | undefined {
+		this.params[name] = opts;
+		const value = givenParams()[name];
+		if (value === undefined) {
+			return opts.default;
+		}
+		switch (opts.type) {
+			case "number":
+				return Number(value) as ParamTypes[T];
+			case "boolean":
+				return (value === "true") as ParamTypes[T];
+			default:
+				return value as ParamTypes[T];
+		}
+	}
+
 	createTree(): object {
 		const constructs = this.node.children.filter(HarborConstruct.of).reduce((acc, child) => {
 			return {
@@ -129,6 +188,11 @@ export class Package extends Construct {
 			constructs,
 			tasks: this.tasks,
 			setup: this.setup,
+			params: _.mapValues(this.params, param => ({
+				...param,
+				choices: param.choices?.map(String),
+			})),
+			resources: this.resources,
 			packageInfo: this.packageInfo
 		}
 
@@ -74,7 +74,15 @@ const goBuild = new ExecCommand(pkg, "go-build", {
         "-o",
         "harbor",
         "./cmd/harbor/main.go"
-    ]
+    ],
+    inputs: [
+        "go.mod",
+        "go.sum",
+        "**/*.go",
+    ],
+    artifacts: [
+        "harbor",
+    ],
 }).needs(
     config.task("build"),
     tests,
@@ -30,6 +30,6 @@ func main() {
 
 	if err != nil {
 		telemetry.Fatal("Unrecoverable error", err)
-		os.Exit(1)
+		os.Exit(application.ExitCode(err))
 	}
 }
@@ -4,6 +4,7 @@ go 1.22
 
 require (
 	github.com/clarkmcc/go-typescript v0.7.0
+	github.com/klauspost/compress v1.17.9
 	github.com/lmittmann/tint v1.0.5
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.6.1
@@ -3,6 +3,7 @@ package application
 import (
 	"errors"
 	"fmt"
+	"os/exec"
 
 	"github.com/radding/harbor-runner/internal/telemetry"
 )
@@ -33,3 +34,17 @@ func RunApplication(app *Application) (err error) {
 	})
 	return
 }
+
+// ExitCode returns the code to exit with after err. When err comes from a
+// command that exited with a code of its own, like a failed test suite, that
+// code is used, otherwise it is 1.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
+	}
+	return 1
+}
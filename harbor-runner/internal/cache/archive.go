@@ -0,0 +1,316 @@
+package cache
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const archiveVersion = 1
+const archiveIndexFile = "index.json"
+const archiveBlobsDir = "blobs"
+
+// archiveIndex is the first file of an archive, it lists every entry in the
+// archive and the digest of the data the entry holds.
+type archiveIndex struct {
+	Version    int                `json:"version"`
+	Created    time.Time          `json:"created"`
+	Namespaces []archiveNamespace `json:"namespaces"`
+}
+
+type archiveNamespace struct {
+	Namespace string          `json:"namespace"`
+	KeyInputs json.RawMessage `json:"keyInputs,omitempty"`
+	Entries   []archiveEntry  `json:"entries"`
+}
+
+type archiveEntry struct {
+	Key    string `json:"key"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// ArchiveReport summarizes an export or an import.
+type ArchiveReport struct {
+	Namespaces int   `json:"namespaces"`
+	Files      int   `json:"files"`
+	Blobs      int   `json:"blobs"`
+	Bytes      int64 `json:"bytes"`
+}
+
+// Export writes the namespaces selected by include, along with their data, to
+// w as a zstd compressed tarball. A nil include exports everything.
+func (s *Store) Export(w io.Writer, include func(namespace string) bool) (ArchiveReport, error) {
+	report := ArchiveReport{}
+	index, err := s.archiveIndex(include)
+	if err != nil {
+		return report, err
+	}
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return report, errors.Wrap(err, "failed to create compressor")
+	}
+	tw := tar.NewWriter(zw)
+
+	bts, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return report, errors.Wrap(err, "failed to marshal archive index")
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    archiveIndexFile,
+		Mode:    0644,
+		Size:    int64(len(bts)),
+		ModTime: index.Created,
+	})
+	if err != nil {
+		return report, errors.Wrap(err, "failed to write archive index")
+	}
+	if _, err := tw.Write(bts); err != nil {
+		return report, errors.Wrap(err, "failed to write archive index")
+	}
+
+	written := map[string]bool{}
+	for _, namespace := range index.Namespaces {
+		c, err := s.Root().GetSubCache(namespace.Namespace)
+		if err != nil {
+			return report, err
+		}
+		report.Namespaces++
+		for _, entry := range namespace.Entries {
+			report.Files++
+			if written[entry.Digest] {
+				continue
+			}
+			written[entry.Digest] = true
+			err := tw.WriteHeader(&tar.Header{
+				Name:    path.Join(archiveBlobsDir, entry.Digest),
+				Mode:    0644,
+				Size:    entry.Size,
+				ModTime: index.Created,
+			})
+			if err != nil {
+				return report, errors.Wrapf(err, "failed to write %s", entry.Key)
+			}
+			found, err := c.Get(entry.Key, tw)
+			if err != nil {
+				return report, errors.Wrapf(err, "failed to export %s/%s", namespace.Namespace, entry.Key)
+			}
+			if !found {
+				return report, fmt.Errorf("%s/%s disappeared from the cache while exporting", namespace.Namespace, entry.Key)
+			}
+			report.Blobs++
+			report.Bytes += entry.Size
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return report, errors.Wrap(err, "failed to finish archive")
+	}
+	return report, errors.Wrap(zw.Close(), "failed to finish archive")
+}
+
+// archiveIndex lists the entries to export. Entries whose blob is missing are
+// left out, exporting them would only produce an archive that fails to import.
+func (s *Store) archiveIndex(include func(namespace string) bool) (archiveIndex, error) {
+	index := archiveIndex{
+		Version:    archiveVersion,
+		Created:    time.Now(),
+		Namespaces: []archiveNamespace{},
+	}
+	namespaces, err := s.manifestNamespaces()
+	if err != nil {
+		return index, err
+	}
+	for _, namespace := range namespaces {
+		if include != nil && !include(namespace) {
+			continue
+		}
+		m, err := s.readManifest(namespace)
+		if err != nil {
+			return index, errors.Wrapf(err, "failed to read %s", namespace)
+		}
+		exported := archiveNamespace{
+			Namespace: namespace,
+			KeyInputs: m.KeyInputs,
+			Entries:   []archiveEntry{},
+		}
+		for _, key := range sortedEntryKeys(m) {
+			entry := m.Entries[key]
+			if _, err := os.Stat(s.blobPath(entry.Digest)); err != nil {
+				slog.Warn("skipping cache entry with a missing blob", slog.String("namespace", namespace), slog.String("cache_file", key))
+				continue
+			}
+			exported.Entries = append(exported.Entries, archiveEntry{
+				Key:    key,
+				Digest: entry.Digest,
+				Size:   entry.Size,
+			})
+		}
+		if len(exported.Entries) > 0 {
+			index.Namespaces = append(index.Namespaces, exported)
+		}
+	}
+	return index, nil
+}
+
+func sortedEntryKeys(m manifest) []string {
+	keys := make([]string, 0, len(m.Entries))
+	for key := range m.Entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Import adds every entry of an archive written by Export to the store. The
+// whole archive is verified against its index before anything is added, so a
+// corrupted or truncated archive leaves the store untouched.
+func (s *Store) Import(r io.Reader) (ArchiveReport, error) {
+	report := ArchiveReport{}
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return report, errors.Wrap(err, "failed to open archive")
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return report, errors.Wrap(err, "failed to read archive")
+	}
+	if hdr.Name != archiveIndexFile {
+		return report, fmt.Errorf("not a harbor cache archive, expected %s but found %s", archiveIndexFile, hdr.Name)
+	}
+	index := archiveIndex{}
+	if err := json.NewDecoder(tr).Decode(&index); err != nil {
+		return report, errors.Wrap(err, "failed to parse archive index")
+	}
+	if index.Version != archiveVersion {
+		return report, fmt.Errorf("unsupported archive version %d", index.Version)
+	}
+	sizes := map[string]int64{}
+	for _, namespace := range index.Namespaces {
+		if _, err := s.Root().GetSubCache(namespace.Namespace); err != nil {
+			return report, errors.Wrap(err, "archive contains an invalid namespace")
+		}
+		for _, entry := range namespace.Entries {
+			sizes[entry.Digest] = entry.Size
+		}
+	}
+
+	staging, err := os.MkdirTemp(filepath.Join(s.base, tmpDir), "import-*")
+	if err != nil {
+		return report, errors.Wrap(err, "failed to create staging directory")
+	}
+	defer os.RemoveAll(staging)
+	staged := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, errors.Wrap(err, "failed to read archive")
+		}
+		digest, ok := strings.CutPrefix(hdr.Name, archiveBlobsDir+"/")
+		size, expected := sizes[digest]
+		if !ok || !expected {
+			slog.Warn("skipping unexpected file in archive", slog.String("file", hdr.Name))
+			continue
+		}
+		file, err := stageBlob(staging, digest, size, tr)
+		if err != nil {
+			return report, err
+		}
+		staged[digest] = file
+		report.Blobs++
+		report.Bytes += size
+	}
+	for digest := range sizes {
+		if _, ok := staged[digest]; !ok {
+			return report, fmt.Errorf("archive is incomplete, blob %s is missing", digest)
+		}
+	}
+
+	for _, namespace := range index.Namespaces {
+		c, err := s.Root().GetSubCache(namespace.Namespace)
+		if err != nil {
+			return report, err
+		}
+		for _, entry := range namespace.Entries {
+			err := addFile(c, entry.Key, staged[entry.Digest])
+			if err != nil {
+				return report, errors.Wrapf(err, "failed to import %s/%s", namespace.Namespace, entry.Key)
+			}
+			report.Files++
+		}
+		if len(namespace.KeyInputs) > 0 {
+			if err := s.setKeyInputs(namespace.Namespace, namespace.KeyInputs); err != nil {
+				return report, err
+			}
+		}
+		report.Namespaces++
+	}
+	return report, nil
+}
+
+// stageBlob writes a blob from the archive to the staging directory and checks
+// that it matches the digest and size recorded in the index.
+func stageBlob(staging, digest string, size int64, data io.Reader) (string, error) {
+	fileName := filepath.Join(staging, filepath.Base(digest))
+	fi, err := os.Create(fileName)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to stage blob")
+	}
+	h := sha256.New()
+	num, err := io.Copy(io.MultiWriter(fi, h), data)
+	closeErr := fi.Close()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read blob %s", digest)
+	}
+	if closeErr != nil {
+		return "", errors.Wrap(closeErr, "failed to stage blob")
+	}
+	if num != size {
+		return "", fmt.Errorf("blob %s is truncated, expected %d bytes but found %d", digest, size, num)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return "", fmt.Errorf("blob %s is corrupted, its contents hash to %s", digest, actual)
+	}
+	return fileName, nil
+}
+
+func addFile(c Cache, key, fileName string) error {
+	fi, err := os.Open(fileName)
+	if err != nil {
+		return errors.Wrap(err, "failed to open staged blob")
+	}
+	defer fi.Close()
+	return c.Add(key, fi)
+}
+
+func (s *Store) setKeyInputs(namespace string, keyInputs json.RawMessage) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := s.loadManifest(namespace)
+	if err != nil {
+		return err
+	}
+	m.KeyInputs = keyInputs
+	return s.writeManifest(namespace, m)
+}
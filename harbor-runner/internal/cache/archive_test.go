@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func addEntry(t *testing.T, store *Store, namespace, key, content string) {
+	sub, err := store.Root().GetSubCache(namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Add(key, strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getEntry(t *testing.T, store *Store, namespace, key string) (string, bool) {
+	sub, err := store.Root().GetSubCache(namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buff := new(bytes.Buffer)
+	found, err := sub.Get(key, buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buff.String(), found
+}
+
+// tamper rewrites every blob of an archive, keeping its size the same.
+func tamper(t *testing.T, archive []byte) []byte {
+	zr, err := zstd.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	out := new(bytes.Buffer)
+	zw, err := zstd.NewWriter(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(zw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != archiveIndexFile {
+			data = bytes.Repeat([]byte("x"), len(data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	zw.Close()
+	return out.Bytes()
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir())
+	assert.NoError(err)
+	addEntry(t, store, "tasks/pkg/build/abc", "info.log", "built")
+	addEntry(t, store, "tasks/pkg/build/abc/artifacts", "bin", "binary")
+	addEntry(t, store, "tasks/pkg/test/def", "info.log", "built")
+	sub, err := store.Root().GetSubCache("tasks/pkg/build/abc")
+	assert.NoError(err)
+	assert.NoError(sub.(StatsRecorder).RecordRun(false, json.RawMessage(`{"kind":"exec"}`)))
+
+	archive := new(bytes.Buffer)
+	report, err := store.Export(archive, func(namespace string) bool {
+		return strings.HasPrefix(namespace, "tasks/pkg/build/")
+	})
+	assert.NoError(err)
+	assert.Equal(2, report.Namespaces)
+	assert.Equal(2, report.Blobs)
+
+	other, err := Open(t.TempDir())
+	assert.NoError(err)
+	report, err = other.Import(bytes.NewReader(archive.Bytes()))
+	assert.NoError(err)
+	assert.Equal(2, report.Files)
+
+	content, found := getEntry(t, other, "tasks/pkg/build/abc", "info.log")
+	assert.True(found)
+	assert.Equal("built", content)
+	content, found = getEntry(t, other, "tasks/pkg/build/abc/artifacts", "bin")
+	assert.True(found)
+	assert.Equal("binary", content)
+	_, found = getEntry(t, other, "tasks/pkg/test/def", "info.log")
+	assert.False(found)
+
+	entries, err := other.Entries()
+	assert.NoError(err)
+	assert.Len(entries, 1)
+	assert.JSONEq(`{"kind":"exec"}`, string(entries[0].KeyInputs))
+}
+
+func TestImportRejectsCorruptedArchives(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir())
+	assert.NoError(err)
+	addEntry(t, store, "tasks/pkg/build/abc", "info.log", "built")
+	archive := new(bytes.Buffer)
+	_, err = store.Export(archive, nil)
+	assert.NoError(err)
+
+	other, err := Open(t.TempDir())
+	assert.NoError(err)
+	_, err = other.Import(bytes.NewReader(tamper(t, archive.Bytes())))
+	assert.ErrorContains(err, "corrupted")
+	_, err = other.Import(bytes.NewReader(archive.Bytes()[:archive.Len()/2]))
+	assert.Error(err)
+
+	_, found := getEntry(t, other, "tasks/pkg/build/abc", "info.log")
+	assert.False(found)
+	assert.Equal(0, countBlobs(t, other))
+}
@@ -1,24 +1,17 @@
 package cache
 
 import (
-	"fmt"
+	"encoding/json"
 	"io"
 	"log/slog"
-	"os"
-	"path"
 
 	"github.com/pkg/errors"
-	"github.com/radding/harbor-runner/internal/telemetry"
 )
 
 type CacheContextKey string
 
 const CacheContextKeyValue = CacheContextKey("Cacher")
 
-type cache struct {
-	CachePath string `json:"cache_path"`
-}
-
 type NonCache struct{}
 
 func (n *NonCache) Add(key string, data io.Reader) error {
@@ -48,74 +41,50 @@ type Cache interface {
 	GetSubCache(key string) (Cache, error)
 }
 
-func (c *cache) Add(key string, data io.Reader) error {
-	return telemetry.TimeWithError(fmt.Sprintf("add_to_cache_%s", key), func() error {
-		cacheFile := path.Join(c.CachePath, key)
-		slog.Debug("Writing to cache file", slog.String("cache_file", key))
-		fi, err := os.OpenFile(cacheFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-		if err != nil {
-			return errors.Wrap(err, "failed to open cahce file")
-		}
-		defer fi.Close()
-		num, err := io.Copy(fi, data)
-		if err != nil {
-			return errors.Wrap(err, "failed to write to cache file")
-		}
-		slog.Debug(fmt.Sprintf("Wrote %d bytes to cache file", num), slog.String("cache_file", key))
-		return nil
-	})
+// StatsRecorder is implemented by caches that keep statistics about how their
+// entries are used.
+type StatsRecorder interface {
+	// RecordRun records whether the entries were replayed (a hit) or had to be
+	// produced (a miss), along with a description of the key they live under.
+	RecordRun(hit bool, keyInputs json.RawMessage) error
+}
+
+// Quarantiner is implemented by caches that can set aside entries a reader
+// found to be unusable, like a cached config that no longer parses. The entry
+// is treated as a miss from then on.
+type Quarantiner interface {
+	Quarantine(key, reason string) error
 }
 
-func (c *cache) Get(key string, dst io.Writer) (bool, error) {
-	success := false
-	err := telemetry.TimeWithError(fmt.Sprintf("add_to_cache_%s", key), func() error {
-		cacheFile := path.Join(c.CachePath, key)
-		slog.Debug("trying to get cache file", slog.String("cache_file", key))
-		fi, err := os.OpenFile(cacheFile, os.O_RDONLY, 0666)
-		if err != nil && os.IsNotExist(err) {
-			slog.Debug("Cache file not found", slog.String("cache_file", key))
-			return nil
-		} else if err != nil {
-			return errors.Wrap(err, "failed to open cache file")
-		}
-		defer fi.Close()
-
-		num, err := io.Copy(dst, fi)
-		if err != nil {
-			return errors.Wrap(err, "failed to copy cached item")
-		}
-		slog.Debug(fmt.Sprintf("copied %d bytes from cached item", num), slog.String("cache_file", key))
-		success = true
+// Quarantine sets aside key if c supports it, so the next Get is a miss.
+func Quarantine(c Cache, key, reason string) error {
+	quarantiner, ok := c.(Quarantiner)
+	if !ok {
 		return nil
-	})
-	return success, err
+	}
+	return quarantiner.Quarantine(key, reason)
 }
 
-func (c *cache) Clean() error {
-	slog.Debug("removing cache directory", slog.String("cache_directory", c.CachePath))
-	return os.RemoveAll(c.CachePath)
+// Checker is implemented by caches that can tell whether they hold an entry
+// without reading it.
+type Checker interface {
+	Has(key string) (bool, error)
 }
 
-func (c *cache) GetSubCache(key string) (Cache, error) {
-	cachePath := path.Join(c.CachePath, key)
-	c2 := &cache{
-		CachePath: cachePath,
-	}
-	err := os.MkdirAll(cachePath, 0744)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to make cache dir")
+// Has reports whether c holds key. It has no side effects on caches that
+// implement Checker, others are asked for the entry itself.
+func Has(c Cache, key string) (bool, error) {
+	checker, ok := c.(Checker)
+	if !ok {
+		return c.Get(key, io.Discard)
 	}
-	return c2, nil
+	return checker.Has(key)
 }
 
 func New(base string) (Cache, error) {
-	err := os.MkdirAll(base, 0744)
+	store, err := Open(base)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to make cache dir")
+		return nil, errors.Wrap(err, "failed to open cache store")
 	}
-	c2 := &cache{
-		CachePath: base,
-	}
-	return c2, nil
-
+	return store.Root(), nil
 }
@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Blobs written by harbor start with a small header naming how the rest of
+// the blob is encoded. Blobs written before compression was supported have no
+// header and are read as they are.
+var blobMagic = []byte("\x00HRB")
+
+const blobFormatVersion = 1
+const blobHeaderSize = 6
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var compressionIDs = map[string]byte{
+	CompressionNone: 0,
+	CompressionGzip: 1,
+	CompressionZstd: 2,
+}
+
+type compression struct {
+	algorithm string
+	// level is the algorithm specific compression level, zero picks the
+	// algorithm's default.
+	level int
+}
+
+func (c compression) validate() error {
+	if _, ok := compressionIDs[c.algorithm]; !ok {
+		return fmt.Errorf("unknown cache compression %q, expected one of none, gzip or zstd", c.algorithm)
+	}
+	if c.algorithm == CompressionGzip && c.level != 0 && (c.level < gzip.BestSpeed || c.level > gzip.BestCompression) {
+		return fmt.Errorf("gzip compression level must be between 1 and 9, got %d", c.level)
+	}
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (n nopWriteCloser) Close() error {
+	return nil
+}
+
+// newWriter writes the blob header to w and returns a writer that encodes
+// everything written to it.
+func (c compression) newWriter(w io.Writer) (io.WriteCloser, error) {
+	header := append(append([]byte{}, blobMagic...), blobFormatVersion, compressionIDs[c.algorithm])
+	if _, err := w.Write(header); err != nil {
+		return nil, errors.Wrap(err, "failed to write blob header")
+	}
+	switch c.algorithm {
+	case CompressionGzip:
+		level := c.level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if c.level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type blobReader struct {
+	io.Reader
+	closers []func() error
+}
+
+func (b *blobReader) Close() error {
+	var err error
+	for i := len(b.closers) - 1; i >= 0; i-- {
+		if closeErr := b.closers[i](); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// openBlob returns the decoded contents of a blob.
+func (s *Store) openBlob(digest string) (io.ReadCloser, error) {
+	fi, err := os.Open(s.blobPath(digest))
+	if err != nil {
+		return nil, err
+	}
+	reader := &blobReader{
+		closers: []func() error{fi.Close},
+	}
+	buffered := bufio.NewReader(fi)
+	header, err := buffered.Peek(blobHeaderSize)
+	if err != nil || !bytes.Equal(header[:len(blobMagic)], blobMagic) {
+		reader.Reader = buffered
+		return reader, nil
+	}
+	if header[len(blobMagic)] != blobFormatVersion {
+		fi.Close()
+		return nil, errors.Wrapf(errCorruptBlob, "unknown blob format version %d", header[len(blobMagic)])
+	}
+	buffered.Discard(blobHeaderSize)
+	switch header[len(blobMagic)+1] {
+	case compressionIDs[CompressionNone]:
+		reader.Reader = buffered
+	case compressionIDs[CompressionGzip]:
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			fi.Close()
+			return nil, errors.Wrap(errCorruptBlob, err.Error())
+		}
+		reader.Reader = gz
+		reader.closers = append(reader.closers, gz.Close)
+	case compressionIDs[CompressionZstd]:
+		zr, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			fi.Close()
+			return nil, errors.Wrap(errCorruptBlob, err.Error())
+		}
+		reader.Reader = zr
+		reader.closers = append(reader.closers, func() error {
+			zr.Close()
+			return nil
+		})
+	default:
+		fi.Close()
+		return nil, errors.Wrapf(errCorruptBlob, "unknown blob compression %d", header[len(blobMagic)+1])
+	}
+	return reader, nil
+}
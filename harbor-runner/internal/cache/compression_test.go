@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressedRoundTrip(t *testing.T) {
+	content := strings.Repeat("compile all the things\n", 1000)
+	for _, algorithm := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(algorithm, func(t *testing.T) {
+			assert := assert.New(t)
+			store, err := Open(t.TempDir(), WithCompression(algorithm, 0))
+			assert.NoError(err)
+			addEntry(t, store, "tasks/pkg/build/abc", "info.log", content)
+
+			got, found := getEntry(t, store, "tasks/pkg/build/abc", "info.log")
+			assert.True(found)
+			assert.Equal(content, got)
+			info, err := os.Stat(blobOf(t, store, "tasks/pkg/build/abc", "info.log"))
+			assert.NoError(err)
+			if algorithm == CompressionNone {
+				assert.Equal(int64(len(content)+blobHeaderSize), info.Size())
+			} else {
+				assert.Less(info.Size(), int64(len(content)/10))
+			}
+			report, err := store.Verify(true)
+			assert.NoError(err)
+			assert.Empty(report.Problems)
+		})
+	}
+}
+
+func TestReadsBlobsWithoutHeader(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir())
+	assert.NoError(err)
+	content := []byte("written before compression")
+	h := sha256.Sum256(content)
+	digest := hex.EncodeToString(h[:])
+	assert.NoError(os.MkdirAll(filepath.Dir(store.blobPath(digest)), 0744))
+	assert.NoError(os.WriteFile(store.blobPath(digest), content, 0644))
+	assert.NoError(store.writeManifest("abc", manifest{
+		Entries: map[string]manifestEntry{
+			"config.json": {Digest: digest, Size: int64(len(content)), Created: time.Now(), Accessed: time.Now()},
+		},
+	}))
+
+	got, found := getEntry(t, store, "abc", "config.json")
+	assert.True(found)
+	assert.Equal(string(content), got)
+}
+
+func TestCorruptedCompressedBlobsAreMisses(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir(), WithCompression(CompressionGzip, 9))
+	assert.NoError(err)
+	addEntry(t, store, "tasks/pkg/build/abc", "info.log", strings.Repeat("output", 100))
+	blob := blobOf(t, store, "tasks/pkg/build/abc", "info.log")
+	bts, err := os.ReadFile(blob)
+	assert.NoError(err)
+	assert.NoError(os.WriteFile(blob, bts[:len(bts)/2], 0644))
+
+	_, found := getEntry(t, store, "tasks/pkg/build/abc", "info.log")
+	assert.False(found)
+}
+
+func TestOpenRejectsUnknownCompression(t *testing.T) {
+	_, err := Open(t.TempDir(), WithCompression("brotli", 0))
+	assert.ErrorContains(t, err, "unknown cache compression")
+	_, err = Open(t.TempDir(), WithCompression(CompressionGzip, 12))
+	assert.Error(t, err)
+}
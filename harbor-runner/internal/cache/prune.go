@@ -0,0 +1,291 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Entry is a group of cached files that is kept or evicted as a whole, like
+// the result of one run of a task together with its artifacts.
+type Entry struct {
+	Namespace  string    `json:"namespace"`
+	Size       int64     `json:"size"`
+	Created    time.Time `json:"created"`
+	LastAccess time.Time `json:"lastAccess"`
+	Files      int       `json:"files"`
+	Hits       int       `json:"hits"`
+	Misses     int       `json:"misses"`
+	LastHit    time.Time `json:"lastHit"`
+	// KeyInputs describes what produced the key the entry is stored under.
+	KeyInputs json.RawMessage `json:"keyInputs,omitempty"`
+	digests   map[string]bool
+}
+
+// Entries lists every entry in the store. An entry is a namespace holding a
+// manifest together with all of the namespaces below it.
+func (s *Store) Entries() ([]*Entry, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.entries()
+}
+
+func (s *Store) entries() ([]*Entry, error) {
+	namespaces, err := s.manifestNamespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*Entry{}
+	byNamespace := map[string]*Entry{}
+	for _, namespace := range namespaces {
+		entry := owningEntry(byNamespace, namespace)
+		if entry == nil {
+			entry = &Entry{
+				Namespace: namespace,
+				digests:   map[string]bool{},
+			}
+			byNamespace[namespace] = entry
+			entries = append(entries, entry)
+		}
+		m, err := s.readManifest(namespace)
+		if err != nil {
+			slog.Warn("skipping unreadable manifest", slog.String("namespace", namespace), slog.String("error", err.Error()))
+			continue
+		}
+		if entry.Namespace == namespace {
+			entry.Hits = m.Stats.Hits
+			entry.Misses = m.Stats.Misses
+			entry.LastHit = m.Stats.LastHit
+			entry.KeyInputs = m.KeyInputs
+		}
+		for _, file := range m.Entries {
+			entry.Files++
+			if !entry.digests[file.Digest] {
+				entry.digests[file.Digest] = true
+				entry.Size += s.blobSize(file.Digest)
+			}
+			if entry.Created.IsZero() || file.Created.Before(entry.Created) {
+				entry.Created = file.Created
+			}
+			if file.Accessed.After(entry.LastAccess) {
+				entry.LastAccess = file.Accessed
+			}
+		}
+	}
+	return entries, nil
+}
+
+// manifestNamespaces lists every namespace holding a manifest, sorted so that
+// parents come before their children.
+func (s *Store) manifestNamespaces() ([]string, error) {
+	root := filepath.Join(s.base, manifestsDir)
+	namespaces := []string{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != manifestFile {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		namespaces = append(namespaces, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to walk manifests")
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+func owningEntry(byNamespace map[string]*Entry, namespace string) *Entry {
+	for parent := path.Dir(namespace); parent != "." && parent != "/"; parent = path.Dir(parent) {
+		if entry, ok := byNamespace[parent]; ok {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (s *Store) blobSize(digest string) int64 {
+	info, err := os.Stat(s.blobPath(digest))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// PrunePolicy decides which entries Prune evicts.
+type PrunePolicy struct {
+	// MaxSize is the number of bytes the store may use, least recently used
+	// entries are evicted until it fits. Zero means no limit.
+	MaxSize int64
+	// MaxAge evicts every entry that was not used for this long. Zero means no
+	// limit.
+	MaxAge time.Duration
+	// Keep protects namespaces from being evicted.
+	Keep func(namespace string) bool
+	// DryRun reports what would be evicted without removing anything.
+	DryRun bool
+}
+
+type PrunedEntry struct {
+	Entry
+	Reason string `json:"reason"`
+}
+
+type PruneReport struct {
+	Evicted      []PrunedEntry `json:"evicted"`
+	RemovedBlobs int           `json:"removedBlobs"`
+	FreedBytes   int64         `json:"freedBytes"`
+	TotalBytes   int64         `json:"totalBytes"`
+}
+
+// Prune evicts entries according to policy and removes the blobs that are no
+// longer referenced by any entry. The store stays locked throughout, so entries
+// added by other processes in the meantime never lose their blobs.
+func (s *Store) Prune(policy PrunePolicy) (PruneReport, error) {
+	report := PruneReport{
+		Evicted: []PrunedEntry{},
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+	entries, err := s.entries()
+	if err != nil {
+		return report, err
+	}
+	blobs, err := s.blobs()
+	if err != nil {
+		return report, err
+	}
+	for _, size := range blobs {
+		report.TotalBytes += size
+	}
+
+	refs := map[string]int{}
+	for _, entry := range entries {
+		for digest := range entry.digests {
+			refs[digest]++
+		}
+	}
+	remaining := report.TotalBytes
+	evict := func(entry *Entry, reason string) {
+		report.Evicted = append(report.Evicted, PrunedEntry{
+			Entry:  *entry,
+			Reason: reason,
+		})
+		for digest := range entry.digests {
+			refs[digest]--
+			if refs[digest] == 0 {
+				remaining -= blobs[digest]
+			}
+		}
+	}
+	for digest, size := range blobs {
+		if refs[digest] == 0 {
+			remaining -= size
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastAccess.Before(entries[j].LastAccess)
+	})
+	now := time.Now()
+	for _, entry := range entries {
+		if policy.Keep != nil && policy.Keep(entry.Namespace) {
+			continue
+		}
+		if policy.MaxAge > 0 && now.Sub(entry.LastAccess) > policy.MaxAge {
+			evict(entry, fmt.Sprintf("not used for %s", now.Sub(entry.LastAccess).Round(time.Minute)))
+		} else if policy.MaxSize > 0 && remaining > policy.MaxSize {
+			evict(entry, fmt.Sprintf("cache is over its %d byte budget", policy.MaxSize))
+		}
+	}
+
+	for digest, size := range blobs {
+		if refs[digest] <= 0 {
+			report.RemovedBlobs++
+			report.FreedBytes += size
+		}
+	}
+	if policy.DryRun {
+		return report, nil
+	}
+
+	for _, evicted := range report.Evicted {
+		slog.Debug("evicting cache entry", slog.String("namespace", evicted.Namespace), slog.String("reason", evicted.Reason))
+		err := os.RemoveAll(filepath.Dir(s.manifestPath(evicted.Namespace)))
+		if err != nil {
+			return report, errors.Wrapf(err, "failed to evict %s", evicted.Namespace)
+		}
+	}
+	for digest := range blobs {
+		if refs[digest] > 0 {
+			continue
+		}
+		err := os.Remove(s.blobPath(digest))
+		if err != nil && !os.IsNotExist(err) {
+			return report, errors.Wrapf(err, "failed to remove blob %s", digest)
+		}
+	}
+	s.removeStaleTemporaries(now)
+	return report, nil
+}
+
+// blobs returns the size on disk of every blob in the store.
+func (s *Store) blobs() (map[string]int64, error) {
+	blobs := map[string]int64{}
+	err := filepath.WalkDir(filepath.Join(s.base, blobsDir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		blobs[d.Name()] = info.Size()
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to walk blobs")
+	}
+	return blobs, nil
+}
+
+// removeStaleTemporaries cleans up temporary files left behind by writes that
+// were interrupted.
+func (s *Store) removeStaleTemporaries(now time.Time) {
+	dir := filepath.Join(s.base, tmpDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil || now.Sub(info.ModTime()) < time.Hour {
+			continue
+		}
+		os.RemoveAll(filepath.Join(dir, file.Name()))
+	}
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func addAged(t *testing.T, store *Store, namespace, content string, age time.Duration) {
+	sub, err := store.Root().GetSubCache(namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Add("info.log", strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	m, err := store.readManifest(namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, entry := range m.Entries {
+		entry.Accessed = time.Now().Add(-age)
+		m.Entries[key] = entry
+	}
+	if err := store.writeManifest(namespace, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func has(t *testing.T, store *Store, namespace string) bool {
+	sub, err := store.Root().GetSubCache(namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := sub.Get("info.log", new(bytes.Buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestPruneEvictsLeastRecentlyUsedFirst(t *testing.T) {
+	assert := assert.New(t)
+	// sizes are measured on disk, keep them predictable
+	store, err := Open(t.TempDir(), WithCompression(CompressionNone, 0))
+	assert.NoError(err)
+	addAged(t, store, "tasks/pkg/build/old", strings.Repeat("a", 100), 3*time.Hour)
+	addAged(t, store, "tasks/pkg/build/newer", strings.Repeat("b", 100), 2*time.Hour)
+	addAged(t, store, "tasks/pkg/test/newest", strings.Repeat("c", 100), time.Hour)
+
+	report, err := store.Prune(PrunePolicy{MaxSize: 150})
+	assert.NoError(err)
+	assert.Len(report.Evicted, 2)
+	assert.Equal("tasks/pkg/build/old", report.Evicted[0].Namespace)
+	assert.Equal("tasks/pkg/build/newer", report.Evicted[1].Namespace)
+	assert.Equal(2, report.RemovedBlobs)
+	assert.False(has(t, store, "tasks/pkg/build/old"))
+	assert.True(has(t, store, "tasks/pkg/test/newest"))
+	assert.Equal(1, countBlobs(t, store))
+}
+
+func TestPruneByAgeKeepsSharedBlobs(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir())
+	assert.NoError(err)
+	addAged(t, store, "tasks/pkg/build/stale", "shared output", 48*time.Hour)
+	addAged(t, store, "tasks/pkg/build/fresh", "shared output", time.Minute)
+	addAged(t, store, "abc123", "config", 48*time.Hour)
+
+	report, err := store.Prune(PrunePolicy{
+		MaxAge: 24 * time.Hour,
+		Keep: func(namespace string) bool {
+			return namespace == "abc123"
+		},
+	})
+	assert.NoError(err)
+	assert.Len(report.Evicted, 1)
+	assert.Equal(0, report.RemovedBlobs)
+	assert.True(has(t, store, "tasks/pkg/build/fresh"))
+	assert.True(has(t, store, "abc123"))
+}
+
+func TestPruneDryRun(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir())
+	assert.NoError(err)
+	addAged(t, store, "tasks/pkg/build/stale", "output", 48*time.Hour)
+
+	report, err := store.Prune(PrunePolicy{MaxAge: time.Hour, DryRun: true})
+	assert.NoError(err)
+	assert.Len(report.Evicted, 1)
+	assert.True(has(t, store, "tasks/pkg/build/stale"))
+}
@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/radding/harbor-runner/internal/telemetry"
+)
+
+// remoteCache shares entries through a harbor cache server. Every entry is
+// also kept in a local cache which is always consulted first, and the remote
+// is only ever an optimization: when it can't be reached harbor keeps working
+// off of the local cache.
+type remoteCache struct {
+	baseURL   string
+	namespace string
+	readOnly  bool
+	local     Cache
+	client    *http.Client
+}
+
+type RemoteOption func(r *remoteCache) *remoteCache
+
+// WithReadOnly stops the remote cache from uploading entries, useful for
+// developer machines that should only consume what CI produced.
+func WithReadOnly(readOnly bool) RemoteOption {
+	return func(r *remoteCache) *remoteCache {
+		r.readOnly = readOnly
+		return r
+	}
+}
+
+// WithHTTPClient replaces the client used to talk to the cache server.
+func WithHTTPClient(client *http.Client) RemoteOption {
+	return func(r *remoteCache) *remoteCache {
+		r.client = client
+		return r
+	}
+}
+
+// NewRemote returns a cache backed by the cache server at baseURL that falls
+// back to local.
+func NewRemote(baseURL string, local Cache, opts ...RemoteOption) Cache {
+	r := &remoteCache{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		local:   local,
+		client: &http.Client{
+			Timeout: 5 * time.Minute,
+		},
+	}
+	for _, opt := range opts {
+		r = opt(r)
+	}
+	return r
+}
+
+func (r *remoteCache) entryURL(key string) string {
+	segments := []string{}
+	for _, segment := range strings.Split(path.Join(r.namespace, key), "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	return fmt.Sprintf("%s/%s", r.baseURL, strings.Join(segments, "/"))
+}
+
+func (r *remoteCache) do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	telemetry.Http(telemetry.HttpData{
+		Start:  true,
+		Method: req.Method,
+		Url:    req.URL.String(),
+	})
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	telemetry.Http(telemetry.HttpData{
+		Method:     req.Method,
+		Url:        req.URL.String(),
+		StatusCode: int64(resp.StatusCode),
+		Latencyms:  time.Since(start).Milliseconds(),
+	})
+	return resp, nil
+}
+
+func (r *remoteCache) Add(key string, data io.Reader) error {
+	err := r.local.Add(key, data)
+	if err != nil {
+		return errors.Wrap(err, "failed to add to local cache")
+	}
+	if r.readOnly {
+		return nil
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		found, err := r.local.Get(key, writer)
+		if err == nil && !found {
+			err = fmt.Errorf("entry %s vanished from the local cache", key)
+		}
+		writer.CloseWithError(err)
+	}()
+	req, err := http.NewRequest(http.MethodPut, r.entryURL(key), reader)
+	if err != nil {
+		reader.Close()
+		return errors.Wrap(err, "failed to create upload request")
+	}
+	resp, err := r.do(req)
+	if err != nil {
+		reader.Close()
+		slog.Warn("failed to upload to remote cache, keeping the entry locally", slog.String("cache_file", key), slog.String("error", err.Error()))
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("remote cache rejected upload, keeping the entry locally", slog.String("cache_file", key), slog.Int("status_code", resp.StatusCode))
+	}
+	return nil
+}
+
+func (r *remoteCache) Get(key string, dst io.Writer) (bool, error) {
+	found, err := r.local.Get(key, dst)
+	if err != nil || found {
+		return found, err
+	}
+	req, err := http.NewRequest(http.MethodGet, r.entryURL(key), nil)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create download request")
+	}
+	resp, err := r.do(req)
+	if err != nil {
+		slog.Warn("failed to reach remote cache, using the local cache only", slog.String("cache_file", key), slog.String("error", err.Error()))
+		return false, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		slog.Debug("remote cache entry not found", slog.String("cache_file", key))
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		slog.Warn("remote cache returned an unexpected status, treating it as a miss", slog.String("cache_file", key), slog.Int("status_code", resp.StatusCode))
+		return false, nil
+	}
+	err = r.local.Add(key, resp.Body)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to store remote entry locally")
+	}
+	slog.Debug("downloaded entry from remote cache", slog.String("cache_file", key))
+	return r.local.Get(key, dst)
+}
+
+// Has checks the local cache first and then asks the remote, an unreachable
+// remote counts as not having the entry.
+func (r *remoteCache) Has(key string) (bool, error) {
+	found, err := Has(r.local, key)
+	if err != nil || found {
+		return found, err
+	}
+	req, err := http.NewRequest(http.MethodHead, r.entryURL(key), nil)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create request")
+	}
+	resp, err := r.do(req)
+	if err != nil {
+		slog.Warn("failed to reach remote cache, using the local cache only", slog.String("cache_file", key), slog.String("error", err.Error()))
+		return false, nil
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+func (r *remoteCache) RecordRun(hit bool, keyInputs json.RawMessage) error {
+	recorder, ok := r.local.(StatsRecorder)
+	if !ok {
+		return nil
+	}
+	return recorder.RecordRun(hit, keyInputs)
+}
+
+func (r *remoteCache) Quarantine(key, reason string) error {
+	return Quarantine(r.local, key, reason)
+}
+
+// Clean only cleans the local cache, the remote is shared with others.
+func (r *remoteCache) Clean() error {
+	return r.local.Clean()
+}
+
+func (r *remoteCache) GetSubCache(key string) (Cache, error) {
+	local, err := r.local.GetSubCache(key)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteCache{
+		baseURL:   r.baseURL,
+		namespace: path.Join(r.namespace, key),
+		readOnly:  r.readOnly,
+		local:     local,
+		client:    r.client,
+	}, nil
+}
@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newRemote(t *testing.T, url string, opts ...RemoteOption) Cache {
+	local, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := NewRemote(url, local, opts...).GetSubCache("pkg/build/abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func TestRemoteCacheSharesEntries(t *testing.T) {
+	assert := assert.New(t)
+	serverStore, err := Open(t.TempDir())
+	assert.NoError(err)
+	server := httptest.NewServer(NewServer(serverStore))
+	defer server.Close()
+
+	ci := newRemote(t, server.URL)
+	assert.NoError(ci.Add("info.log", strings.NewReader("built on CI")))
+	assert.NoError(ci.Add("empty.log", strings.NewReader("")))
+
+	laptop := newRemote(t, server.URL)
+	buff := new(bytes.Buffer)
+	found, err := laptop.Get("info.log", buff)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal("built on CI", buff.String())
+
+	found, err = laptop.Get("empty.log", new(bytes.Buffer))
+	assert.NoError(err)
+	assert.True(found)
+
+	found, err = laptop.Get("error.log", new(bytes.Buffer))
+	assert.NoError(err)
+	assert.False(found)
+}
+
+func TestRemoteCacheReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	serverStore, err := Open(t.TempDir())
+	assert.NoError(err)
+	server := httptest.NewServer(NewServer(serverStore))
+	defer server.Close()
+
+	laptop := newRemote(t, server.URL, WithReadOnly(true))
+	assert.NoError(laptop.Add("info.log", strings.NewReader("local only")))
+
+	other := newRemote(t, server.URL)
+	found, err := other.Get("info.log", new(bytes.Buffer))
+	assert.NoError(err)
+	assert.False(found)
+}
+
+func TestRemoteCacheFallsBackToLocal(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(NewServer(nil))
+	server.Close()
+
+	c := newRemote(t, server.URL)
+	assert.NoError(c.Add("info.log", strings.NewReader("still cached")))
+	buff := new(bytes.Buffer)
+	found, err := c.Get("info.log", buff)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal("still cached", buff.String())
+
+	found, err = c.Get("error.log", new(bytes.Buffer))
+	assert.NoError(err)
+	assert.False(found)
+}
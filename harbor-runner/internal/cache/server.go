@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/radding/harbor-runner/internal/telemetry"
+)
+
+// server implements the protocol remoteCache speaks on top of a Store: the
+// request path is the entry's namespace followed by its key, GET and HEAD
+// read entries and PUT writes them.
+type server struct {
+	store *Store
+}
+
+// NewServer returns a handler serving the entries of store to remote caches.
+func NewServer(store *Store) http.Handler {
+	return &server{
+		store: store,
+	}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	telemetry.Http(telemetry.HttpData{
+		Start:  true,
+		Method: r.Method,
+		Url:    r.URL.String(),
+	})
+	status := s.serve(w, r)
+	telemetry.Http(telemetry.HttpData{
+		Method:     r.Method,
+		Url:        r.URL.String(),
+		StatusCode: int64(status),
+		Latencyms:  time.Since(start).Milliseconds(),
+	})
+}
+
+func (s *server) serve(w http.ResponseWriter, r *http.Request) int {
+	c, key, err := s.resolve(r.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return http.StatusBadRequest
+	}
+	switch r.Method {
+	case http.MethodGet:
+		// Buffer through a pipe so a miss can still be answered with a 404.
+		reader, writer := io.Pipe()
+		found := make(chan bool, 1)
+		go func() {
+			notify := &notifyWriter{w: writer, found: found}
+			ok, err := c.Get(key, notify)
+			if err != nil {
+				slog.Warn("failed to read cache entry", slog.String("key", key), slog.String("error", err.Error()))
+			}
+			if !notify.notified {
+				found <- ok && err == nil
+			}
+			writer.CloseWithError(err)
+		}()
+		if !<-found {
+			reader.Close()
+			http.NotFound(w, r)
+			return http.StatusNotFound
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if _, err := io.Copy(w, reader); err != nil {
+			slog.Warn("failed to send cache entry", slog.String("key", key), slog.String("error", err.Error()))
+		}
+		return http.StatusOK
+	case http.MethodHead:
+		ok, err := c.Get(key, io.Discard)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return http.StatusInternalServerError
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return http.StatusNotFound
+		}
+		w.WriteHeader(http.StatusOK)
+		return http.StatusOK
+	case http.MethodPut:
+		defer r.Body.Close()
+		if err := c.Add(key, r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return http.StatusInternalServerError
+		}
+		w.WriteHeader(http.StatusCreated)
+		return http.StatusCreated
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return http.StatusMethodNotAllowed
+	}
+}
+
+// resolve maps a request path onto the namespace and key it addresses.
+func (s *server) resolve(u *url.URL) (Cache, string, error) {
+	segments := []string{}
+	for _, segment := range strings.Split(strings.Trim(u.EscapedPath(), "/"), "/") {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, "", err
+		}
+		segments = append(segments, unescaped)
+	}
+	key := segments[len(segments)-1]
+	if key == "" {
+		return nil, "", fmt.Errorf("no cache key in %s", u.Path)
+	}
+	c := s.store.Root()
+	if len(segments) > 1 {
+		var err error
+		c, err = c.GetSubCache(strings.Join(segments[:len(segments)-1], "/"))
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return c, key, nil
+}
+
+// notifyWriter reports that an entry was found the first time data is written.
+type notifyWriter struct {
+	w        io.Writer
+	found    chan bool
+	notified bool
+}
+
+func (n *notifyWriter) Write(b []byte) (int, error) {
+	if !n.notified {
+		n.notified = true
+		n.found <- true
+	}
+	return n.w.Write(b)
+}
@@ -0,0 +1,465 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/radding/harbor-runner/internal/filelock"
+	"github.com/radding/harbor-runner/internal/telemetry"
+)
+
+const (
+	blobsDir      = "blobs"
+	manifestsDir  = "manifests"
+	tmpDir        = "tmp"
+	quarantineDir = "quarantine"
+	manifestFile  = "manifest.json"
+	lockFile      = "store.lock"
+)
+
+// StoreDirs are the directories a Store manages inside of its base directory.
+var StoreDirs = []string{blobsDir, manifestsDir, tmpDir, quarantineDir}
+
+// RunsDir is the directory next to the store that keeps what harbor remembers
+// about past runs, like the journal of an interrupted run and how long tasks
+// took. It is not part of the cache and survives cleaning it.
+const RunsDir = "runs"
+
+// Store is a content addressable cache. Every piece of data added to it is
+// written once as a blob named after its SHA-256 digest, and each namespace
+// (what GetSubCache hands out) keeps a small manifest mapping its keys to
+// blobs. Identical logs and artifacts are therefore only stored once, no
+// matter how many tasks, packages or config revisions produce them.
+//
+// Several harbor processes may share a store. Blobs and manifests are written
+// to a temporary file and renamed into place so readers never see half written
+// data, and every change to a manifest happens while holding the store's file
+// lock.
+//
+// Blobs are compressed with zstd unless configured otherwise, their digest is
+// always taken over the uncompressed contents.
+type Store struct {
+	base        string
+	compression compression
+}
+
+type Option func(s *Store) *Store
+
+// WithCompression sets the algorithm (none, gzip or zstd) and level new blobs
+// are compressed with. A level of zero picks the algorithm's default.
+func WithCompression(algorithm string, level int) Option {
+	return func(s *Store) *Store {
+		s.compression = compression{
+			algorithm: algorithm,
+			level:     level,
+		}
+		return s
+	}
+}
+
+type manifest struct {
+	Entries   map[string]manifestEntry `json:"entries"`
+	Stats     manifestStats            `json:"stats"`
+	KeyInputs json.RawMessage          `json:"keyInputs,omitempty"`
+}
+
+type manifestStats struct {
+	Hits    int       `json:"hits"`
+	Misses  int       `json:"misses"`
+	LastHit time.Time `json:"lastHit"`
+}
+
+type manifestEntry struct {
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	Accessed time.Time `json:"accessed"`
+}
+
+// Open opens the store rooted at base, creating it if needed.
+func Open(base string, opts ...Option) (*Store, error) {
+	s := &Store{
+		base: base,
+		compression: compression{
+			algorithm: CompressionZstd,
+		},
+	}
+	for _, opt := range opts {
+		s = opt(s)
+	}
+	if err := s.compression.validate(); err != nil {
+		return nil, err
+	}
+	for _, dir := range StoreDirs {
+		err := os.MkdirAll(filepath.Join(base, dir), 0744)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to make cache dir")
+		}
+	}
+	return s, nil
+}
+
+// Base returns the directory the store lives in.
+func (s *Store) Base() string {
+	return s.base
+}
+
+// Root returns the cache for the store's root namespace.
+func (s *Store) Root() Cache {
+	return &cache{
+		store: s,
+	}
+}
+
+// Namespaces lists the top level namespaces that hold entries.
+func (s *Store) Namespaces() ([]string, error) {
+	dirs, err := os.ReadDir(filepath.Join(s.base, manifestsDir))
+	if err != nil && os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read manifests")
+	}
+	namespaces := []string{}
+	for _, dir := range dirs {
+		if dir.IsDir() {
+			namespaces = append(namespaces, dir.Name())
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// lock blocks until this process holds the store's lock, the returned func
+// releases it.
+func (s *Store) lock() (func(), error) {
+	l, err := filelock.Acquire(filepath.Join(s.base, lockFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to lock the cache")
+	}
+	return func() {
+		if err := l.Release(); err != nil {
+			slog.Warn("failed to release the cache lock", slog.String("error", err.Error()))
+		}
+	}, nil
+}
+
+func (s *Store) blobPath(digest string) string {
+	return filepath.Join(s.base, blobsDir, digest[:2], digest)
+}
+
+func (s *Store) manifestPath(namespace string) string {
+	return filepath.Join(s.base, manifestsDir, filepath.FromSlash(namespace), manifestFile)
+}
+
+// writeBlob streams data into a temporary file and returns its name, digest
+// and uncompressed size. The caller removes the file once it committed the
+// blob.
+func (s *Store) writeBlob(data io.Reader) (string, string, int64, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.base, tmpDir), "blob-*")
+	if err != nil {
+		return "", "", 0, errors.Wrap(err, "failed to create temporary blob")
+	}
+	h := sha256.New()
+	num := int64(0)
+	encoder, err := s.compression.newWriter(tmp)
+	if err == nil {
+		num, err = io.Copy(io.MultiWriter(encoder, h), data)
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", 0, errors.Wrap(err, "failed to write blob")
+	}
+	return tmp.Name(), hex.EncodeToString(h.Sum(nil)), num, nil
+}
+
+// commitBlob moves a blob written by writeBlob into place, the store must be
+// locked so a concurrent prune can't remove a blob that is being referenced.
+func (s *Store) commitBlob(tmp, digest string) error {
+	blob := s.blobPath(digest)
+	if _, err := os.Stat(blob); err == nil {
+		slog.Debug("blob already stored", slog.String("digest", digest))
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(blob), 0744); err != nil {
+		return errors.Wrap(err, "failed to make blob dir")
+	}
+	if err := os.Rename(tmp, blob); err != nil {
+		return errors.Wrap(err, "failed to move blob into place")
+	}
+	return nil
+}
+
+func (s *Store) readManifest(namespace string) (manifest, error) {
+	m := manifest{
+		Entries: map[string]manifestEntry{},
+	}
+	bts, err := os.ReadFile(s.manifestPath(namespace))
+	if err != nil && os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return m, errors.Wrap(err, "failed to read manifest")
+	}
+	if err := json.Unmarshal(bts, &m); err != nil {
+		return m, errors.Wrap(errCorruptManifest, err.Error())
+	}
+	if m.Entries == nil {
+		m.Entries = map[string]manifestEntry{}
+	}
+	return m, nil
+}
+
+func (s *Store) writeManifest(namespace string, m manifest) error {
+	fileName := s.manifestPath(namespace)
+	if err := os.MkdirAll(filepath.Dir(fileName), 0744); err != nil {
+		return errors.Wrap(err, "failed to make manifest dir")
+	}
+	bts, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal manifest")
+	}
+	return s.writeFileAtomic(fileName, bts)
+}
+
+// writeFileAtomic replaces fileName with data, readers either see the old or
+// the new contents but never a partial write.
+func (s *Store) writeFileAtomic(fileName string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Join(s.base, tmpDir), "manifest-*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write temporary file")
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return errors.Wrap(err, "failed to set file mode")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), fileName), "failed to move file into place")
+}
+
+// touch records that an entry was just read, pruning evicts the entries that
+// were read least recently first.
+func (s *Store) touch(namespace, key string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := s.loadManifest(namespace)
+	if err != nil {
+		return err
+	}
+	entry, ok := m.Entries[key]
+	if !ok {
+		return nil
+	}
+	entry.Accessed = time.Now()
+	m.Entries[key] = entry
+	return s.writeManifest(namespace, m)
+}
+
+// recordRun implements StatsRecorder. Namespaces without entries are skipped,
+// tasks that never cache anything shouldn't show up as entries.
+func (s *Store) recordRun(namespace string, hit bool, keyInputs json.RawMessage) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := s.loadManifest(namespace)
+	if err != nil {
+		return err
+	}
+	if len(m.Entries) == 0 {
+		return nil
+	}
+	if hit {
+		m.Stats.Hits++
+		m.Stats.LastHit = time.Now()
+	} else {
+		m.Stats.Misses++
+	}
+	if len(keyInputs) > 0 {
+		m.KeyInputs = keyInputs
+	}
+	return s.writeManifest(namespace, m)
+}
+
+// cache is a namespace inside of a Store.
+type cache struct {
+	store     *Store
+	namespace string
+}
+
+func (c *cache) Add(key string, data io.Reader) error {
+	return telemetry.TimeWithError(fmt.Sprintf("add_to_cache_%s", key), func() error {
+		slog.Debug("Writing to cache", slog.String("cache_file", key), slog.String("namespace", c.namespace))
+		tmp, digest, num, err := c.store.writeBlob(data)
+		if err != nil {
+			return errors.Wrap(err, "failed to write to cache")
+		}
+		defer os.Remove(tmp)
+		unlock, err := c.store.lock()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if err := c.store.commitBlob(tmp, digest); err != nil {
+			return errors.Wrap(err, "failed to write to cache")
+		}
+		m, err := c.store.loadManifest(c.namespace)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		m.Entries[key] = manifestEntry{
+			Digest:   digest,
+			Size:     num,
+			Created:  now,
+			Accessed: now,
+		}
+		if err := c.store.writeManifest(c.namespace, m); err != nil {
+			return errors.Wrap(err, "failed to write manifest")
+		}
+		slog.Debug(fmt.Sprintf("Wrote %d bytes to cache", num), slog.String("cache_file", key), slog.String("digest", digest))
+		return nil
+	})
+}
+
+func (c *cache) Get(key string, dst io.Writer) (bool, error) {
+	success := false
+	err := telemetry.TimeWithError(fmt.Sprintf("get_from_cache_%s", key), func() error {
+		slog.Debug("trying to get cache entry", slog.String("cache_file", key), slog.String("namespace", c.namespace))
+		m, err := c.store.readManifest(c.namespace)
+		if errors.Cause(err) == errCorruptManifest {
+			return c.store.healManifest(c.namespace)
+		} else if err != nil {
+			return err
+		}
+		entry, ok := m.Entries[key]
+		if !ok {
+			slog.Debug("Cache entry not found", slog.String("cache_file", key))
+			return nil
+		}
+		// the blob is read and verified before anything is written to dst, a
+		// corrupted entry must never be replayed.
+		verified := new(bytes.Buffer)
+		err = c.store.readBlob(entry, verified)
+		if os.IsNotExist(err) {
+			slog.Warn("cache entry points at a missing blob, treating it as a miss", slog.String("cache_file", key), slog.String("digest", entry.Digest))
+			return nil
+		} else if errors.Cause(err) == errCorruptBlob {
+			slog.Warn("cache entry is corrupted, quarantining it and treating it as a miss", slog.String("cache_file", key), slog.String("namespace", c.namespace), slog.String("error", err.Error()))
+			return c.store.quarantineBlob(c.namespace, key, entry)
+		} else if err != nil {
+			return errors.Wrap(err, "failed to read blob")
+		}
+
+		num, err := io.Copy(dst, verified)
+		if err != nil {
+			return errors.Wrap(err, "failed to copy cached item")
+		}
+		slog.Debug(fmt.Sprintf("copied %d bytes from cached item", num), slog.String("cache_file", key))
+		success = true
+		if err := c.store.touch(c.namespace, key); err != nil {
+			slog.Debug("failed to record cache access", slog.String("cache_file", key), slog.String("error", err.Error()))
+		}
+		return nil
+	})
+	return success, err
+}
+
+// Has reports whether the namespace holds key, without verifying or touching
+// the entry.
+func (c *cache) Has(key string) (bool, error) {
+	m, err := c.store.readManifest(c.namespace)
+	if errors.Cause(err) == errCorruptManifest {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	entry, ok := m.Entries[key]
+	if !ok {
+		return false, nil
+	}
+	_, err = os.Stat(c.store.blobPath(entry.Digest))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *cache) RecordRun(hit bool, keyInputs json.RawMessage) error {
+	return c.store.recordRun(c.namespace, hit, keyInputs)
+}
+
+func (c *cache) Quarantine(key, reason string) error {
+	return c.store.quarantineEntry(c.namespace, key, reason)
+}
+
+// Clean removes every entry in this namespace and the namespaces below it.
+// Blobs are shared between namespaces so they are left for garbage collection.
+// Cleaning the root namespace removes the whole store, but not RunsDir which
+// isn't part of the cache.
+func (c *cache) Clean() error {
+	if c.namespace == "" {
+		slog.Debug("removing cache directory", slog.String("cache_directory", c.store.base))
+		entries, err := os.ReadDir(c.store.base)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to read cache directory")
+		}
+		for _, entry := range entries {
+			if entry.Name() == RunsDir {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(c.store.base, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	unlock, err := c.store.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	dir := filepath.Dir(c.store.manifestPath(c.namespace))
+	slog.Debug("removing cache namespace", slog.String("namespace", c.namespace))
+	return os.RemoveAll(dir)
+}
+
+func (c *cache) GetSubCache(key string) (Cache, error) {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return nil, fmt.Errorf("invalid sub cache name %q", key)
+		}
+	}
+	return &cache{
+		store:     c.store,
+		namespace: path.Join(c.namespace, key),
+	}, nil
+}
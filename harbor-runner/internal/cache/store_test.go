@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func countBlobs(t *testing.T, store *Store) int {
+	count := 0
+	err := filepath.WalkDir(filepath.Join(store.Base(), blobsDir), func(p string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			count++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir())
+	assert.NoError(err)
+
+	sub, err := store.Root().GetSubCache("tasks/pkg/build")
+	assert.NoError(err)
+	assert.NoError(sub.Add("info.log", strings.NewReader("hello world")))
+
+	buff := new(bytes.Buffer)
+	found, err := sub.Get("info.log", buff)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal("hello world", buff.String())
+
+	found, err = sub.Get("error.log", buff)
+	assert.NoError(err)
+	assert.False(found)
+}
+
+func TestStoreDeduplicatesBlobs(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir())
+	assert.NoError(err)
+
+	for _, namespace := range []string{"abc123", "def456", "tasks/pkg/test/key"} {
+		sub, err := store.Root().GetSubCache(namespace)
+		assert.NoError(err)
+		assert.NoError(sub.Add("info.log", strings.NewReader("same output")))
+	}
+	assert.Equal(1, countBlobs(t, store))
+
+	namespaces, err := store.Namespaces()
+	assert.NoError(err)
+	assert.Equal([]string{"abc123", "def456", "tasks"}, namespaces)
+}
+
+func TestStoreCleanNamespace(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir())
+	assert.NoError(err)
+
+	old, err := store.Root().GetSubCache("old")
+	assert.NoError(err)
+	assert.NoError(old.Add("config.json", strings.NewReader("{}")))
+	current, err := store.Root().GetSubCache("current")
+	assert.NoError(err)
+	assert.NoError(current.Add("config.json", strings.NewReader("{}")))
+
+	assert.NoError(old.Clean())
+	found, err := old.Get("config.json", new(bytes.Buffer))
+	assert.NoError(err)
+	assert.False(found)
+	found, err = current.Get("config.json", new(bytes.Buffer))
+	assert.NoError(err)
+	assert.True(found)
+}
+
+func TestHasLeavesEntriesUntouched(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir())
+	assert.NoError(err)
+	sub, err := store.Root().GetSubCache("tasks/pkg/build")
+	assert.NoError(err)
+	assert.NoError(sub.Add("info.log", strings.NewReader("hello world")))
+	before, err := store.readManifest("tasks/pkg/build")
+	assert.NoError(err)
+
+	found, err := Has(sub, "info.log")
+	assert.NoError(err)
+	assert.True(found)
+	found, err = Has(sub, "error.log")
+	assert.NoError(err)
+	assert.False(found)
+	after, err := store.readManifest("tasks/pkg/build")
+	assert.NoError(err)
+	assert.Equal(before, after)
+
+	assert.NoError(os.Remove(store.blobPath(after.Entries["info.log"].Digest)))
+	found, err = Has(sub, "info.log")
+	assert.NoError(err)
+	assert.False(found)
+}
+
+func TestStoreRejectsEscapingNamespaces(t *testing.T) {
+	store, err := Open(t.TempDir())
+	assert.NoError(t, err)
+	_, err = store.Root().GetSubCache("../outside")
+	assert.Error(t, err)
+	_, err = store.Root().GetSubCache("..--config")
+	assert.NoError(t, err)
+}
+
+func TestRecordRunKeepsStatistics(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir())
+	assert.NoError(err)
+	sub, err := store.Root().GetSubCache("tasks/pkg/build/abc123")
+	assert.NoError(err)
+	recorder := sub.(StatsRecorder)
+
+	assert.NoError(recorder.RecordRun(false, nil))
+	entries, err := store.Entries()
+	assert.NoError(err)
+	assert.Len(entries, 0)
+
+	assert.NoError(sub.Add("info.log", strings.NewReader("output")))
+	assert.NoError(recorder.RecordRun(false, json.RawMessage(`{"kind":"exec"}`)))
+	assert.NoError(recorder.RecordRun(true, nil))
+	assert.NoError(recorder.RecordRun(true, nil))
+
+	entries, err = store.Entries()
+	assert.NoError(err)
+	assert.Len(entries, 1)
+	assert.Equal(2, entries[0].Hits)
+	assert.Equal(1, entries[0].Misses)
+	assert.False(entries[0].LastHit.IsZero())
+	assert.JSONEq(`{"kind":"exec"}`, string(entries[0].KeyInputs))
+}
+
+func TestConcurrentWritersNeverExposePartialEntries(t *testing.T) {
+	assert := assert.New(t)
+	base := t.TempDir()
+	contents := []string{strings.Repeat("a", 1<<16), strings.Repeat("b", 1<<17)}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// every writer opens its own store, like separate harbor processes do
+			store, err := Open(base)
+			if !assert.NoError(err) {
+				return
+			}
+			sub, err := store.Root().GetSubCache("tasks/pkg/build/abc")
+			if !assert.NoError(err) {
+				return
+			}
+			for j := 0; j < 10; j++ {
+				assert.NoError(sub.Add("info.log", strings.NewReader(contents[(i+j)%2])))
+				buff := new(bytes.Buffer)
+				found, err := sub.Get("info.log", buff)
+				assert.NoError(err)
+				assert.True(found)
+				assert.Contains(contents, buff.String())
+			}
+		}(i)
+	}
+	wg.Wait()
+}
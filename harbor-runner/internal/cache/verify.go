@@ -0,0 +1,240 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errCorruptManifest = errors.New("manifest is corrupted")
+var errCorruptBlob = errors.New("blob does not match its checksum")
+
+// verifyBlob checks that the decoded blob of entry still hashes to its digest.
+func (s *Store) verifyBlob(entry manifestEntry) error {
+	return s.readBlob(entry, io.Discard)
+}
+
+// readBlob copies the contents of the blob of entry to dst, hashing them on
+// the way. It fails with errCorruptBlob when they don't match the entry, after
+// dst got them, so callers that must not see corrupted contents read into a
+// buffer.
+func (s *Store) readBlob(entry manifestEntry, dst io.Writer) error {
+	fi, err := s.openBlob(entry.Digest)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	h := sha256.New()
+	num, err := io.Copy(io.MultiWriter(h, dst), fi)
+	if err != nil {
+		return errors.Wrap(errCorruptBlob, err.Error())
+	}
+	if num != entry.Size {
+		return errors.Wrapf(errCorruptBlob, "expected %d bytes but found %d", entry.Size, num)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != entry.Digest {
+		return errors.Wrapf(errCorruptBlob, "contents hash to %s", actual)
+	}
+	return nil
+}
+
+// loadManifest reads a manifest while the store is locked, a corrupted
+// manifest is quarantined and replaced by an empty one.
+func (s *Store) loadManifest(namespace string) (manifest, error) {
+	m, err := s.readManifest(namespace)
+	if errors.Cause(err) != errCorruptManifest {
+		return m, err
+	}
+	slog.Warn("cache manifest is corrupted, quarantining it", slog.String("namespace", namespace), slog.String("error", err.Error()))
+	if err := s.quarantineManifest(namespace); err != nil {
+		return m, err
+	}
+	return manifest{
+		Entries: map[string]manifestEntry{},
+	}, nil
+}
+
+// healManifest quarantines the manifest of namespace if it is still corrupted
+// once the store is locked.
+func (s *Store) healManifest(namespace string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	_, err = s.loadManifest(namespace)
+	return err
+}
+
+func (s *Store) quarantinePath(name string) string {
+	return filepath.Join(s.base, quarantineDir, name)
+}
+
+func (s *Store) quarantineManifest(namespace string) error {
+	name := fmt.Sprintf("manifest-%s-%d.json", strings.ReplaceAll(namespace, "/", "_"), time.Now().UnixNano())
+	err := os.Rename(s.manifestPath(namespace), s.quarantinePath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to quarantine manifest")
+	}
+	return nil
+}
+
+// quarantineBlob moves a corrupted blob out of the store and drops the entry
+// pointing at it.
+func (s *Store) quarantineBlob(namespace, key string, entry manifestEntry) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := s.moveBlobToQuarantine(entry.Digest); err != nil {
+		return err
+	}
+	return s.dropEntry(namespace, key, entry.Digest)
+}
+
+func (s *Store) moveBlobToQuarantine(digest string) error {
+	err := os.Rename(s.blobPath(digest), s.quarantinePath(digest))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to quarantine blob")
+	}
+	return nil
+}
+
+// dropEntry removes key from the manifest of namespace, unless it was
+// replaced by a different blob in the meantime.
+func (s *Store) dropEntry(namespace, key, digest string) error {
+	m, err := s.loadManifest(namespace)
+	if err != nil {
+		return err
+	}
+	if current, ok := m.Entries[key]; !ok || current.Digest != digest {
+		return nil
+	}
+	delete(m.Entries, key)
+	return s.writeManifest(namespace, m)
+}
+
+// quarantineEntry sets aside an entry whose data is intact but unusable. The
+// blob may be shared with other entries, so it is copied instead of moved.
+func (s *Store) quarantineEntry(namespace, key, reason string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := s.loadManifest(namespace)
+	if err != nil {
+		return err
+	}
+	entry, ok := m.Entries[key]
+	if !ok {
+		return nil
+	}
+	slog.Warn("quarantining cache entry", slog.String("namespace", namespace), slog.String("cache_file", key), slog.String("reason", reason))
+	bts, err := os.ReadFile(s.blobPath(entry.Digest))
+	if err == nil {
+		err = os.WriteFile(s.quarantinePath(entry.Digest), bts, 0644)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		slog.Debug("failed to keep a copy of the quarantined entry", slog.String("error", err.Error()))
+	}
+	return s.dropEntry(namespace, key, entry.Digest)
+}
+
+// VerifyProblem is an entry that failed verification.
+type VerifyProblem struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+	Problem   string `json:"problem"`
+}
+
+type VerifyReport struct {
+	Namespaces int             `json:"namespaces"`
+	Entries    int             `json:"entries"`
+	Problems   []VerifyProblem `json:"problems"`
+}
+
+// Verify checks every manifest and blob in the store. Unless dryRun is set,
+// corrupted manifests and blobs are quarantined and the entries pointing at
+// them dropped, so they are rebuilt the next time they are needed.
+func (s *Store) Verify(dryRun bool) (VerifyReport, error) {
+	report := VerifyReport{
+		Problems: []VerifyProblem{},
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+	namespaces, err := s.manifestNamespaces()
+	if err != nil {
+		return report, err
+	}
+	verified := map[string]error{}
+	for _, namespace := range namespaces {
+		report.Namespaces++
+		m, err := s.readManifest(namespace)
+		if errors.Cause(err) == errCorruptManifest {
+			report.Problems = append(report.Problems, VerifyProblem{
+				Namespace: namespace,
+				Problem:   err.Error(),
+			})
+			if !dryRun {
+				if err := s.quarantineManifest(namespace); err != nil {
+					return report, err
+				}
+			}
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		changed := false
+		for _, key := range sortedEntryKeys(m) {
+			entry := m.Entries[key]
+			report.Entries++
+			blobErr, ok := verified[entry.Digest]
+			if !ok {
+				blobErr = s.verifyBlob(entry)
+				verified[entry.Digest] = blobErr
+				if errors.Cause(blobErr) == errCorruptBlob && !dryRun {
+					if err := s.moveBlobToQuarantine(entry.Digest); err != nil {
+						return report, err
+					}
+				}
+			}
+			if blobErr == nil {
+				continue
+			}
+			problem := blobErr.Error()
+			if os.IsNotExist(blobErr) {
+				problem = "blob is missing"
+			} else if errors.Cause(blobErr) != errCorruptBlob {
+				return report, blobErr
+			}
+			report.Problems = append(report.Problems, VerifyProblem{
+				Namespace: namespace,
+				Key:       key,
+				Digest:    entry.Digest,
+				Problem:   problem,
+			})
+			delete(m.Entries, key)
+			changed = true
+		}
+		if changed && !dryRun {
+			if err := s.writeManifest(namespace, m); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func blobOf(t *testing.T, store *Store, namespace, key string) string {
+	m, err := store.readManifest(namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.blobPath(m.Entries[key].Digest)
+}
+
+func TestGetQuarantinesCorruptedEntries(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir())
+	assert.NoError(err)
+	addEntry(t, store, "tasks/pkg/build/abc", "info.log", "good output")
+	addEntry(t, store, "tasks/pkg/test/abc", "info.log", "short")
+	assert.NoError(os.WriteFile(blobOf(t, store, "tasks/pkg/build/abc", "info.log"), []byte("evil output"), 0644))
+	assert.NoError(os.WriteFile(blobOf(t, store, "tasks/pkg/test/abc", "info.log"), []byte("sh"), 0644))
+
+	sub, err := store.Root().GetSubCache("tasks/pkg/build/abc")
+	assert.NoError(err)
+	buff := new(bytes.Buffer)
+	found, err := sub.Get("info.log", buff)
+	assert.NoError(err)
+	assert.False(found)
+	assert.Empty(buff.String())
+	_, found = getEntry(t, store, "tasks/pkg/test/abc", "info.log")
+	assert.False(found)
+
+	quarantined, err := os.ReadDir(store.quarantinePath(""))
+	assert.NoError(err)
+	assert.Len(quarantined, 2)
+
+	addEntry(t, store, "tasks/pkg/build/abc", "info.log", "good output")
+	content, found := getEntry(t, store, "tasks/pkg/build/abc", "info.log")
+	assert.True(found)
+	assert.Equal("good output", content)
+}
+
+func TestCorruptedManifestsAreMisses(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir())
+	assert.NoError(err)
+	addEntry(t, store, "tasks/pkg/build/abc", "info.log", "output")
+	assert.NoError(os.WriteFile(store.manifestPath("tasks/pkg/build/abc"), []byte(`{"entries":`), 0644))
+
+	_, found := getEntry(t, store, "tasks/pkg/build/abc", "info.log")
+	assert.False(found)
+	addEntry(t, store, "tasks/pkg/build/abc", "info.log", "output")
+	_, found = getEntry(t, store, "tasks/pkg/build/abc", "info.log")
+	assert.True(found)
+}
+
+func TestQuarantineKeepsSharedBlobs(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir())
+	assert.NoError(err)
+	addEntry(t, store, "abc", "config.json", "{}")
+	addEntry(t, store, "def", "config.json", "{}")
+	sub, err := store.Root().GetSubCache("abc")
+	assert.NoError(err)
+	assert.NoError(Quarantine(sub, "config.json", "does not parse"))
+
+	_, found := getEntry(t, store, "abc", "config.json")
+	assert.False(found)
+	_, found = getEntry(t, store, "def", "config.json")
+	assert.True(found)
+}
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+	store, err := Open(t.TempDir())
+	assert.NoError(err)
+	addEntry(t, store, "tasks/pkg/build/abc", "info.log", "output")
+	addEntry(t, store, "tasks/pkg/build/abc", "error.log", "")
+	addEntry(t, store, "tasks/pkg/test/abc", "info.log", "output")
+	addEntry(t, store, "tasks/pkg/lint/abc", "info.log", "fine")
+	assert.NoError(os.WriteFile(blobOf(t, store, "tasks/pkg/build/abc", "info.log"), []byte("0utput"), 0644))
+
+	report, err := store.Verify(true)
+	assert.NoError(err)
+	assert.Equal(4, report.Entries)
+	assert.Len(report.Problems, 2)
+	_, err = os.Stat(blobOf(t, store, "tasks/pkg/build/abc", "info.log"))
+	assert.NoError(err)
+
+	report, err = store.Verify(false)
+	assert.NoError(err)
+	assert.Len(report.Problems, 2)
+	report, err = store.Verify(false)
+	assert.NoError(err)
+	assert.Equal(2, report.Entries)
+	assert.Empty(report.Problems)
+	_, found := getEntry(t, store, "tasks/pkg/lint/abc", "info.log")
+	assert.True(found)
+}
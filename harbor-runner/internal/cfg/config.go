@@ -23,6 +23,14 @@ func (c *ConfigLifeCycle) Initialize() error {
 	viper.SetDefault("log_level", telemetry.InfoLevel)
 	viper.SetDefault("log_format_json", false)
 	viper.SetDefault("plugin_cache", "$HOME/.harbor/plugins/cache")
+	viper.SetDefault("remote_cache_url", "")
+	viper.SetDefault("remote_cache_read_only", false)
+	viper.SetDefault("cache_max_size", "")
+	viper.SetDefault("cache_max_age", "0s")
+	viper.SetDefault("cache_compression", "zstd")
+	viper.SetDefault("cache_compression_level", 0)
+	viper.BindEnv("remote_cache_url")
+	viper.BindEnv("remote_cache_read_only")
 
 	if err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
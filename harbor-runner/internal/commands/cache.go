@@ -3,11 +3,19 @@ package commands
 import (
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/radding/harbor-runner/internal/cache"
 	packageconfig "github.com/radding/harbor-runner/internal/package-config"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 func boolPtr(b bool) *bool {
@@ -23,8 +31,24 @@ func init() {
 	CacheClean.Flags().BoolVarP(cleanAllCache, "all", "a", false, "Clean all cached elements, both old and new")
 	CacheClean.Flags().BoolVarP(cleanOnlyOld, "old", "o", false, "Only clean the old items out")
 	Cache.AddCommand(CacheInfo)
+	Cache.AddCommand(CacheServe)
+	Cache.AddCommand(CachePrune)
+	Cache.AddCommand(CacheVerify)
+	CachePrune.Flags().StringVar(&pruneMaxSize, "max-size", "", "Evict least recently used entries until the cache fits in this size, like 500MB or 2GB. Defaults to cache_max_size")
+	CachePrune.Flags().DurationVar(&pruneMaxAge, "max-age", 0, "Evict entries that were not used for this long, like 72h. Defaults to cache_max_age")
+	CachePrune.Flags().BoolVar(&pruneDryRun, "dry-run", false, "List what would be evicted without removing anything")
+	CacheVerify.Flags().BoolVar(&verifyDryRun, "dry-run", false, "Report corrupted entries without quarantining them")
+	CacheServe.Flags().StringVar(&serveAddr, "addr", ":8080", "The address to listen on")
+	CacheServe.Flags().StringVar(&serveDir, "dir", "./harbor-cache", "The directory to store cache entries in")
 }
 
+var serveAddr string
+var serveDir string
+var pruneMaxSize string
+var pruneMaxAge time.Duration
+var pruneDryRun bool
+var verifyDryRun bool
+
 var Cache = &cobra.Command{
 	Use:   "cache",
 	Short: "manipulate the harbor cache",
@@ -41,39 +65,190 @@ var CacheClean = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		slog.Info("cleaning the cache")
 		cfg := packageconfig.GetConfig()
+		if cfg == nil || cfg.GetStore() == nil {
+			return errors.New("failed to run command, no configuration found")
+		}
+		store := cfg.GetStore()
 		if *cleanAllCache {
-			return os.RemoveAll("./.harbor")
+			return store.Root().Clean()
 		}
 		if *cleanOnlyOld {
-			fileInfos, err := os.ReadDir("./.harbor")
-			slog.Debug(fmt.Sprintf("found %d files", len(fileInfos)))
-			if err != nil && !os.IsNotExist(err) {
-				return errors.Wrap(err, "failed to get .harbor dir")
-			}
-			for _, info := range fileInfos {
-				if info.Name() != cfg.GetHash() {
-					slog.Debug(fmt.Sprintf("deleting cache element %q", info.Name()))
-					err := os.RemoveAll(info.Name())
-					if err != nil {
-						return err
-					}
-				} else {
-					slog.Info("skipping current directory")
-				}
-
-			}
-		}
-		return cfg.GetCache().Clean()
+			return cleanOldCaches(store, cfg.GetHash())
+		}
+		err := cfg.GetCache().Clean()
+		if err != nil {
+			return errors.Wrap(err, "failed to clean config cache")
+		}
+		return cfg.GetTaskCache().Clean()
+	},
+}
+
+// cleanOldCaches removes the caches of previous revisions of the config file,
+// including directories left behind by the old per file cache layout.
+func cleanOldCaches(store *cache.Store, currentHash string) error {
+	namespaces, err := store.Namespaces()
+	if err != nil {
+		return errors.Wrap(err, "failed to list cache namespaces")
+	}
+	for _, namespace := range namespaces {
+		if namespace == currentHash || namespace == "tasks" {
+			slog.Info("skipping current cache", slog.String("namespace", namespace))
+			continue
+		}
+		slog.Debug(fmt.Sprintf("deleting cache element %q", namespace))
+		sub, err := store.Root().GetSubCache(namespace)
+		if err != nil {
+			return err
+		}
+		if err := sub.Clean(); err != nil {
+			return err
+		}
+	}
+
+	fileInfos, err := os.ReadDir(store.Base())
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to get .harbor dir")
+	}
+	for _, info := range fileInfos {
+		if !info.IsDir() || info.Name() == currentHash || slices.Contains(cache.StoreDirs, info.Name()) || info.Name() == cache.RunsDir {
+			continue
+		}
+		slog.Debug(fmt.Sprintf("deleting legacy cache directory %q", info.Name()))
+		err := os.RemoveAll(filepath.Join(store.Base(), info.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var CacheServe = &cobra.Command{
+	Use:   "serve",
+	Short: "serve a remote cache",
+	Long: `Serve a remote cache other harbor installations can share results through.
+	Point harbor at it by setting "remote_cache_url" in ~/.harbor/harbor_cfg.json or HARBOR_REMOTE_CACHE_URL.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := cache.Open(serveDir, packageconfig.CacheOptions()...)
+		if err != nil {
+			return errors.Wrap(err, "failed to open cache directory")
+		}
+		slog.Info(fmt.Sprintf("serving the cache in %s on %s", serveDir, serveAddr))
+		return http.ListenAndServe(serveAddr, cache.NewServer(store))
 	},
 }
 
-var CacheInfo = &cobra.Command{
-	Use:   "info",
-	Short: "get info on the cache",
+var CachePrune = &cobra.Command{
+	Use:   "prune",
+	Short: "evict old cache entries",
+	Long: `Evict least recently used cache entries until the cache fits in --max-size, and every entry not used within --max-age.
+	Blobs no longer referenced by any entry are removed as well.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		slog.Debug("Getting Cache information")
 		cfg := packageconfig.GetConfig()
-		slog.Info(fmt.Sprintf("Base cache hash: %s", cfg.GetHash()))
+		if cfg == nil || cfg.GetStore() == nil {
+			return errors.New("failed to run command, no configuration found")
+		}
+		if !cmd.Flags().Changed("max-size") {
+			pruneMaxSize = viper.GetString("cache_max_size")
+		}
+		if !cmd.Flags().Changed("max-age") {
+			pruneMaxAge = viper.GetDuration("cache_max_age")
+		}
+		maxSize, err := parseSize(pruneMaxSize)
+		if err != nil {
+			return errors.Wrap(err, "invalid max size")
+		}
+		report, err := cfg.GetStore().Prune(cache.PrunePolicy{
+			MaxSize: maxSize,
+			MaxAge:  pruneMaxAge,
+			DryRun:  pruneDryRun,
+			Keep: func(namespace string) bool {
+				return namespace == cfg.GetHash()
+			},
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to prune the cache")
+		}
+		verb := "evicted"
+		if pruneDryRun {
+			verb = "would evict"
+		}
+		for _, entry := range report.Evicted {
+			slog.Info(fmt.Sprintf("%s %s (%s, last used %s): %s", verb, entry.Namespace, formatSize(entry.Size), entry.LastAccess.Format(time.RFC3339), entry.Reason))
+		}
+		slog.Info(fmt.Sprintf("%s %d entries and %d blobs, freeing %s of %s", verb, len(report.Evicted), report.RemovedBlobs, formatSize(report.FreedBytes), formatSize(report.TotalBytes)))
 		return nil
 	},
 }
+
+var CacheVerify = &cobra.Command{
+	Use:   "verify",
+	Short: "check the cache for corrupted entries",
+	Long: `Check every cache entry against its checksum.
+	Corrupted entries are moved to .harbor/quarantine and dropped from the cache, the tasks that produced them run again the next time they are needed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg := packageconfig.GetConfig()
+		if cfg == nil || cfg.GetStore() == nil {
+			return errors.New("failed to run command, no configuration found")
+		}
+		report, err := cfg.GetStore().Verify(verifyDryRun)
+		if err != nil {
+			return errors.Wrap(err, "failed to verify the cache")
+		}
+		for _, problem := range report.Problems {
+			slog.Warn("corrupted cache entry", slog.String("namespace", problem.Namespace), slog.String("cache_file", problem.Key), slog.String("problem", problem.Problem))
+		}
+		slog.Info(fmt.Sprintf("verified %d entries in %d namespaces, found %d problems", report.Entries, report.Namespaces, len(report.Problems)))
+		if len(report.Problems) > 0 && verifyDryRun {
+			return fmt.Errorf("the cache has %d corrupted entries, run harbor cache verify to quarantine them", len(report.Problems))
+		}
+		if len(report.Problems) > 0 {
+			slog.Info(fmt.Sprintf("quarantined corrupted entries in %s", filepath.Join(cfg.GetStore().Base(), "quarantine")))
+		}
+		return nil
+	},
+}
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses human sizes like 500MB or 1.5G, an empty size means no limit.
+func parseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	if size == "" {
+		return 0, nil
+	}
+	multiplier := float64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(size, unit.suffix) {
+			multiplier = unit.bytes
+			size = strings.TrimSpace(strings.TrimSuffix(size, unit.suffix))
+			break
+		}
+	}
+	num, err := strconv.ParseFloat(size, 64)
+	if err != nil || num < 0 {
+		return 0, fmt.Errorf("can not parse size %q", size)
+	}
+	return int64(num * multiplier), nil
+}
+
+func formatSize(size int64) string {
+	for _, unit := range sizeUnits[:4] {
+		if float64(size) >= unit.bytes {
+			return fmt.Sprintf("%.1f%s", float64(size)/unit.bytes, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", size)
+}
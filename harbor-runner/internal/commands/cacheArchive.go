@@ -0,0 +1,109 @@
+package commands
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+	"github.com/spf13/cobra"
+)
+
+var exportTasks []string
+
+func init() {
+	Cache.AddCommand(CacheExport)
+	Cache.AddCommand(CacheImport)
+	CacheExport.Flags().StringSliceVarP(&exportTasks, "task", "t", []string{}, "Only export the cached results of these tasks, by default every entry is exported")
+}
+
+// exportFilter selects the namespaces holding the results of tasks, that is
+// tasks/<id>/<key> and its artifacts but not the results of constructs nested
+// under the task. Tasks can be named like they are for `harbor run`, or by
+// their construct id.
+func exportFilter(cfg *packageconfig.Config, tasks []string) (func(namespace string) bool, error) {
+	if len(tasks) == 0 {
+		return nil, nil
+	}
+	namespaces := map[string]bool{}
+	for _, task := range tasks {
+		id, ok := cfg.Tasks[task]
+		if !ok {
+			if _, ok := cfg.Constructs[task]; !ok {
+				return nil, fmt.Errorf("unknown task %s", task)
+			}
+			id = task
+		}
+		namespaces[path.Join("tasks", id)] = true
+	}
+	return func(namespace string) bool {
+		namespace = strings.TrimSuffix(namespace, "/artifacts")
+		return namespaces[path.Dir(namespace)]
+	}, nil
+}
+
+var CacheExport = &cobra.Command{
+	Use:   "export <file.tar.zst>",
+	Short: "export the cache to an archive",
+	Long: `Bundle cached task results into a compressed archive that "harbor cache import" can load on another machine.
+	Use this to seed fresh CI runners or air-gapped machines with a warm cache.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg := packageconfig.GetConfig()
+		if cfg == nil || cfg.GetStore() == nil {
+			return errors.New("failed to run command, no configuration found")
+		}
+		include, err := exportFilter(cfg, exportTasks)
+		if err != nil {
+			return err
+		}
+		fileName := args[0]
+		tmp, err := os.CreateTemp(filepath.Dir(fileName), ".harbor-export-*")
+		if err != nil {
+			return errors.Wrap(err, "failed to create archive")
+		}
+		defer os.Remove(tmp.Name())
+		report, err := cfg.GetStore().Export(tmp, include)
+		closeErr := tmp.Close()
+		if err != nil {
+			return errors.Wrap(err, "failed to export the cache")
+		}
+		if closeErr != nil {
+			return errors.Wrap(closeErr, "failed to write archive")
+		}
+		if err := os.Rename(tmp.Name(), fileName); err != nil {
+			return errors.Wrap(err, "failed to move archive into place")
+		}
+		slog.Info(fmt.Sprintf("exported %d entries (%d files, %s) to %s", report.Namespaces, report.Files, formatSize(report.Bytes), fileName))
+		return nil
+	},
+}
+
+var CacheImport = &cobra.Command{
+	Use:   "import <file.tar.zst>",
+	Short: "import an archive made by cache export",
+	Long: `Load the entries of an archive made by "harbor cache export" into the cache.
+	The archive is verified before anything is imported, a corrupted archive leaves the cache untouched.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg := packageconfig.GetConfig()
+		if cfg == nil || cfg.GetStore() == nil {
+			return errors.New("failed to run command, no configuration found")
+		}
+		fi, err := os.Open(args[0])
+		if err != nil {
+			return errors.Wrap(err, "failed to open archive")
+		}
+		defer fi.Close()
+		report, err := cfg.GetStore().Import(fi)
+		if err != nil {
+			return errors.Wrapf(err, "failed to import %s", args[0])
+		}
+		slog.Info(fmt.Sprintf("imported %d entries (%d files, %s) from %s", report.Namespaces, report.Files, formatSize(report.Bytes), args[0]))
+		return nil
+	},
+}
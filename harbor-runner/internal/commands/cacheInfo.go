@@ -0,0 +1,186 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/radding/harbor-runner/internal/cache"
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+	"github.com/radding/harbor-runner/internal/taskgraph"
+	"github.com/spf13/cobra"
+)
+
+var cacheInfoOutput string
+
+func init() {
+	CacheInfo.Flags().StringVarP(&cacheInfoOutput, "output", "o", "text", "The output format, one of text, json or table")
+}
+
+type cacheInfo struct {
+	Hash      string          `json:"hash"`
+	TotalSize int64           `json:"totalSize"`
+	Tasks     []taskCacheInfo `json:"tasks"`
+}
+
+type taskCacheInfo struct {
+	Task    string           `json:"task"`
+	Size    int64            `json:"size"`
+	Entries []cacheInfoEntry `json:"entries"`
+}
+
+type cacheInfoEntry struct {
+	Key string `json:"key"`
+	cache.Entry
+}
+
+// collectCacheInfo groups the task entries in the store by the task that
+// produced them, most recently used first.
+func collectCacheInfo(cfg *packageconfig.Config) (cacheInfo, error) {
+	info := cacheInfo{
+		Hash:  cfg.GetHash(),
+		Tasks: []taskCacheInfo{},
+	}
+	entries, err := cfg.GetStore().Entries()
+	if err != nil {
+		return info, errors.Wrap(err, "failed to list cache entries")
+	}
+	byTask := map[string]*taskCacheInfo{}
+	for _, entry := range entries {
+		info.TotalSize += entry.Size
+		namespace, ok := strings.CutPrefix(entry.Namespace, "tasks/")
+		if !ok {
+			continue
+		}
+		task, key := path.Dir(namespace), path.Base(namespace)
+		if _, ok := byTask[task]; !ok {
+			byTask[task] = &taskCacheInfo{
+				Task:    task,
+				Entries: []cacheInfoEntry{},
+			}
+		}
+		byTask[task].Size += entry.Size
+		byTask[task].Entries = append(byTask[task].Entries, cacheInfoEntry{
+			Key:   key,
+			Entry: *entry,
+		})
+	}
+	for _, task := range byTask {
+		sort.Slice(task.Entries, func(i, j int) bool {
+			return task.Entries[i].LastAccess.After(task.Entries[j].LastAccess)
+		})
+		info.Tasks = append(info.Tasks, *task)
+	}
+	sort.Slice(info.Tasks, func(i, j int) bool {
+		return info.Tasks[i].Task < info.Tasks[j].Task
+	})
+	return info, nil
+}
+
+func shortKey(key string) string {
+	if len(key) > 12 {
+		return key[:12]
+	}
+	return key
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+// summarizeKeyInputs describes what went into a cache key in a single line.
+func summarizeKeyInputs(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return "unknown"
+	}
+	inputs := taskgraph.KeyInputs{}
+	if err := json.Unmarshal(raw, &inputs); err != nil {
+		return "unknown"
+	}
+	summary := fmt.Sprintf("%s on %s, %d input files, %d dependencies", inputs.Kind, inputs.Platform, len(inputs.Inputs), len(inputs.Dependencies))
+	if inputs.Fingerprint != "" {
+		summary += ", fingerprinted"
+	}
+	return summary
+}
+
+func writeCacheInfoText(w io.Writer, info cacheInfo) {
+	fmt.Fprintf(w, "Base cache hash: %s\n", info.Hash)
+	fmt.Fprintf(w, "Total size: %s\n", formatSize(info.TotalSize))
+	if len(info.Tasks) == 0 {
+		fmt.Fprintln(w, "No task results are cached")
+		return
+	}
+	for _, task := range info.Tasks {
+		fmt.Fprintf(w, "\n%s (%d entries, %s)\n", task.Task, len(task.Entries), formatSize(task.Size))
+		for _, entry := range task.Entries {
+			fmt.Fprintf(w, "  %s\n", shortKey(entry.Key))
+			fmt.Fprintf(w, "    size:       %s in %d files\n", formatSize(entry.Size), entry.Files)
+			fmt.Fprintf(w, "    created:    %s\n", formatTime(entry.Created))
+			fmt.Fprintf(w, "    last hit:   %s\n", formatTime(entry.LastHit))
+			fmt.Fprintf(w, "    hits:       %d\n", entry.Hits)
+			fmt.Fprintf(w, "    misses:     %d\n", entry.Misses)
+			fmt.Fprintf(w, "    key inputs: %s\n", summarizeKeyInputs(entry.KeyInputs))
+		}
+	}
+}
+
+func writeCacheInfoTable(w io.Writer, info cacheInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK\tKEY\tSIZE\tCREATED\tLAST HIT\tHITS\tMISSES\tKEY INPUTS")
+	for _, task := range info.Tasks {
+		for _, entry := range task.Entries {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+				task.Task,
+				shortKey(entry.Key),
+				formatSize(entry.Size),
+				formatTime(entry.Created),
+				formatTime(entry.LastHit),
+				entry.Hits,
+				entry.Misses,
+				summarizeKeyInputs(entry.KeyInputs),
+			)
+		}
+	}
+	return tw.Flush()
+}
+
+var CacheInfo = &cobra.Command{
+	Use:   "info",
+	Short: "get info on the cache",
+	Long: `Print every cached task result with its size, when it was created and last hit, how often it was hit or missed and what went into its key.
+	Use --output json for the full key inputs.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg := packageconfig.GetConfig()
+		if cfg == nil || cfg.GetStore() == nil {
+			return errors.New("failed to run command, no configuration found")
+		}
+		info, err := collectCacheInfo(cfg)
+		if err != nil {
+			return err
+		}
+		w := cmd.OutOrStdout()
+		switch cacheInfoOutput {
+		case "text":
+			writeCacheInfoText(w, info)
+		case "table":
+			return writeCacheInfoTable(w, info)
+		case "json":
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			return errors.Wrap(encoder.Encode(info), "failed to encode cache info")
+		default:
+			return fmt.Errorf("unknown output %q, expected text, json or table", cacheInfoOutput)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,70 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/radding/harbor-runner/internal/cache"
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+	"github.com/stretchr/testify/assert"
+)
+
+// storeWithRuns opens a store with a run journal and a duration history next
+// to it.
+func storeWithRuns(t *testing.T) (*cache.Store, string, string) {
+	store, err := cache.Open(t.TempDir())
+	assert.NoError(t, err)
+	journal := filepath.Join(store.Base(), cache.RunsDir, "last.json")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(journal), 0744))
+	assert.NoError(t, os.WriteFile(journal, []byte(`{"tasks":["build"]}`), 0644))
+	history := filepath.Join(store.Base(), cache.RunsDir, "history.json")
+	assert.NoError(t, os.WriteFile(history, []byte(`{"tasks":{}}`), 0644))
+	return store, journal, history
+}
+
+func TestCleaningOldCachesKeepsTheRuns(t *testing.T) {
+	assert := assert.New(t)
+	store, journal, history := storeWithRuns(t)
+	assert.NoError(os.MkdirAll(filepath.Join(store.Base(), "legacy"), 0744))
+
+	assert.NoError(cleanOldCaches(store, "current"))
+	assert.FileExists(journal)
+	assert.FileExists(history)
+	assert.NoDirExists(filepath.Join(store.Base(), "legacy"))
+}
+
+func TestCleaningAllCachesKeepsTheRuns(t *testing.T) {
+	assert := assert.New(t)
+	store, journal, history := storeWithRuns(t)
+	sub, err := store.Root().GetSubCache("tasks/build/key")
+	assert.NoError(err)
+	assert.NoError(sub.Add("info.log", strings.NewReader("built")))
+
+	// harbor cache clean --all
+	assert.NoError(store.Root().Clean())
+	assert.FileExists(journal)
+	assert.FileExists(history)
+	for _, dir := range cache.StoreDirs {
+		assert.NoDirExists(filepath.Join(store.Base(), dir))
+	}
+}
+
+func TestExportFilterLeavesOutNestedConstructs(t *testing.T) {
+	assert := assert.New(t)
+	cfg := &packageconfig.Config{
+		Constructs: map[string]packageconfig.Construct{"pkg/build": {}, "pkg/build/child": {}},
+		Tasks:      map[string]string{"build": "pkg/build"},
+	}
+	include, err := exportFilter(cfg, []string{"build"})
+	assert.NoError(err)
+	assert.True(include("tasks/pkg/build/abc"))
+	assert.True(include("tasks/pkg/build/abc/artifacts"))
+	assert.False(include("tasks/pkg/build/child/def"))
+	assert.False(include("tasks/pkg/build/child/def/artifacts"))
+	assert.False(include("tasks/pkg/builder/abc"))
+
+	_, err = exportFilter(cfg, []string{"deploy"})
+	assert.ErrorContains(err, "unknown task deploy")
+}
@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+	"github.com/radding/harbor-runner/internal/taskgraph"
+	"github.com/spf13/cobra"
+)
+
+func createGraphCommand(root *cobra.Command, exec taskgraph.Executor) {
+	output := "dot"
+	setup := false
+	withDependencies := true
+
+	GraphCommand := &cobra.Command{
+		Use:   "graph [task]",
+		Short: "Print the task graph of a task or of the package setup",
+		Long: `Print the graph of constructs a task runs, or that the package setup runs with --setup.
+	The graph can be rendered as Graphviz DOT, as a Mermaid flowchart or as JSON. Edges point from a construct to the constructs that need it, so in the order they run.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if setup {
+				return cobra.NoArgs(cmd, args)
+			}
+			return cobra.ExactArgs(1)(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg := packageconfig.GetConfig()
+			if cfg == nil {
+				return errors.New("failed to print graph, no configuration found")
+			}
+			ctx := cfg.ConfigureContext(cmd.Context())
+			tree, err := taskgraph.CreateTreeFromConfig(cfg, exec)
+			if err != nil {
+				return errors.Wrap(err, "failed to build task tree")
+			}
+			var graph *taskgraph.Graph
+			if setup {
+				graph, err = tree.SetupGraph(ctx, withDependencies)
+			} else {
+				graph, err = tree.TaskGraph(ctx, args[0], withDependencies)
+			}
+			if err != nil {
+				return errors.Wrap(err, "failed to build graph")
+			}
+			out := cmd.OutOrStdout()
+			switch output {
+			case "dot":
+				return graph.WriteDOT(out)
+			case "mermaid":
+				return graph.WriteMermaid(out)
+			case "json":
+				enc := json.NewEncoder(out)
+				enc.SetIndent("", "  ")
+				return enc.Encode(graph)
+			}
+			return fmt.Errorf("unknown output format %s, expected one of dot, mermaid or json", output)
+		},
+	}
+	root.AddCommand(GraphCommand)
+	GraphCommand.Flags().StringVarP(&output, "output", "o", "dot", "The output format, one of dot, mermaid or json")
+	GraphCommand.Flags().BoolVar(&setup, "setup", false, "Print the graph of the package setup instead of a task")
+	GraphCommand.Flags().BoolVar(&withDependencies, "dependencies", true, "Include the tasks run in local dependencies")
+}
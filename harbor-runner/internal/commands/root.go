@@ -1,7 +1,10 @@
 package commands
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/radding/harbor-runner/internal/executor"
 	"github.com/radding/harbor-runner/internal/telemetry"
@@ -29,10 +32,20 @@ func (r *RootExecutor) Initialize() error {
 	rootCmd.ParseFlags(os.Args)
 	createRunCommand(rootCmd, r.Exec)
 	createSetupCommand(rootCmd, r.Exec)
+	createGraphCommand(rootCmd, r.Exec)
 	telemetry.ConfigureLogs(*machineReadableLogs, *logLevel)
 	return nil
 }
 
+// Execute runs the command. The first interrupt cancels the command's context
+// so the commands tasks run are stopped before harbor exits, a second one
+// exits right away.
 func (r *RootExecutor) Execute() error {
-	return rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return rootCmd.ExecuteContext(ctx)
 }
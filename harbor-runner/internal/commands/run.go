@@ -1,10 +1,15 @@
 package commands
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log/slog"
+	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/radding/harbor-runner/internal/cache"
 	packageconfig "github.com/radding/harbor-runner/internal/package-config"
 	"github.com/radding/harbor-runner/internal/taskgraph"
 	"github.com/spf13/cobra"
@@ -15,35 +20,198 @@ func init() {
 }
 
 func createRunCommand(root *cobra.Command, exec taskgraph.Executor) {
+	jobs := 0
+	dryRun := false
+	keepGoing := false
+	params := []string{}
+	showTimings := false
+	resume := false
+
 	RunCommand := &cobra.Command{
-		Use:   "run",
-		Short: "Run a task in the harbor workspace/project",
-		Long: `Run a registered task in the harbor project or Workspace.
-	If this command is run in a workspace, Harbor will go through all projects and find tasks with the same name.`,
+		Use:   "run <task>... [-- <args>...]",
+		Short: "Run tasks in the harbor workspace/project",
+		Long: `Run registered tasks in the harbor project or Workspace.
+	If this command is run in a workspace, Harbor will go through all projects and find tasks with the same name.
+	When several tasks are given they run as a single graph, the tasks they have in common run once.
+	Arguments after -- are appended to the arguments of the given tasks, not to those of the tasks they need.
+	With --resume and no tasks, the interrupted run is resumed as it was started.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if resume && len(args) == 0 {
+				return nil
+			}
+			if cmd.ArgsLenAtDash() == 0 {
+				return errors.New("requires at least 1 task before --")
+			}
+			return cobra.MinimumNArgs(1)(cmd, args)
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
+			args, passthrough := splitPassthrough(cmd, args)
 			cfg := packageconfig.GetConfig()
 			if cfg == nil {
 				return errors.New("failed to run command, no configuration found")
 			}
-			ctx := cfg.ConfigureContext(cmd.Context())
+			given, err := parseParams(params)
+			if err != nil {
+				return err
+			}
+			var journal *taskgraph.Journal
+			if resume {
+				journal, err = taskgraph.ResumeJournal(journalPath(cfg))
+				if err != nil {
+					return err
+				}
+				if len(args) == 0 {
+					args, passthrough, given = journal.Tasks, journal.Args, journal.Params
+				}
+				journal.Tasks, journal.Args, journal.Params = args, passthrough, given
+			}
+			cfg, err = cfg.WithParams(given)
+			if err != nil {
+				return errors.Wrap(err, "failed to load configuration")
+			}
+			ctx := taskgraph.WithJobs(cfg.ConfigureContext(cmd.Context()), jobs)
+			ctx, report := taskgraph.WithReport(taskgraph.WithKeepGoing(ctx, keepGoing))
+			ctx, timings := taskgraph.WithTimings(ctx)
 			tree, err := taskgraph.CreateTreeFromConfig(cfg, exec)
 			if err != nil {
 				return errors.Wrap(err, "failed to build task tree")
 			}
+			if _, err := tree.LookupTasks(args...); err != nil {
+				return err
+			}
+			if dryRun {
+				return printPlan(ctx, cmd.OutOrStdout(), tree, args, passthrough, !cfg.WasSetupRun)
+			}
+			// from here on errors come from the tasks, not from how the
+			// command was used
+			cmd.SilenceUsage = true
+			if journal == nil {
+				journal, err = taskgraph.NewJournal(journalPath(cfg), args, passthrough, given)
+				if err != nil {
+					return err
+				}
+			} else {
+				fmt.Fprintf(cmd.ErrOrStderr(), "resuming %s, %d tasks already succeeded\n", strings.Join(args, ", "), len(journal.Succeeded))
+			}
+			ctx = taskgraph.WithJournal(ctx, journal)
+			history := taskgraph.LoadHistory(historyPath(cfg))
+			ctx = taskgraph.WithHistory(ctx, history)
+			defer saveHistory(history, timings)
+			if showTimings {
+				defer writeTimings(cmd.ErrOrStderr(), timings)
+			}
 			if !cfg.WasSetupRun {
 				slog.Debug("Looks like this setup was never run, running setup now")
 				fmt.Println("setting up package")
 				err := tree.RunSetup(ctx)
 				if err != nil {
+					writeReport(cmd.ErrOrStderr(), report)
 					return errors.Wrap(err, "failed to run package setup")
 				}
 				cfg.WasSetupRun = true
 				cfg.Save()
 			}
-			tree.RunTask(ctx, args[0])
-			return nil
+			err = tree.RunTasks(taskgraph.WithArgs(ctx, passthrough), args...)
+			writeReport(cmd.ErrOrStderr(), report)
+			if err != nil {
+				return errors.Wrapf(err, "failed to run %s, run it again with --resume to skip the tasks that succeeded", strings.Join(args, ", "))
+			}
+			return journal.Finish()
 		},
 	}
 	root.AddCommand(RunCommand)
+	RunCommand.Flags().BoolVar(&dryRun, "dry-run", false, "Print what would run, and whether it would be replayed from the cache, without running anything")
+	RunCommand.Flags().IntVarP(&jobs, "jobs", "j", 0, "How many tasks to run at the same time, defaults to the number of CPUs")
+	RunCommand.Flags().BoolVarP(&keepGoing, "keep-going", "k", false, "Keep running every task that does not need a failed one, instead of stopping at the first failure")
+	RunCommand.Flags().BoolVar(&showTimings, "timings", false, "Print where the time of the run went, including the slowest chain of tasks")
+	RunCommand.Flags().BoolVar(&resume, "resume", false, "Resume the last run, which was interrupted or failed, skipping the tasks that succeeded and haven't changed since")
+	RunCommand.Flags().StringArrayVarP(&params, "param", "p", []string{}, "Set a parameter the package declares, as name=value. Can be repeated")
+
+}
+
+// journalPath is where the journal of the package's last run is kept.
+func journalPath(cfg *packageconfig.Config) string {
+	return filepath.Join(cfg.WorkingDir(), ".harbor", cache.RunsDir, "last.json")
+}
+
+// historyPath is where how long the package's tasks took is kept.
+func historyPath(cfg *packageconfig.Config) string {
+	return filepath.Join(cfg.WorkingDir(), ".harbor", cache.RunsDir, "history.json")
+}
+
+// saveHistory adds the tasks of a run to the history, whether or not the run
+// succeeded.
+func saveHistory(history *taskgraph.History, timings *taskgraph.Timings) {
+	history.Record(timings)
+	if err := history.Save(); err != nil {
+		slog.Warn("failed to save task history", slog.String("error", err.Error()))
+	}
+}
+
+// splitPassthrough splits the task names from the arguments given after --.
+func splitPassthrough(cmd *cobra.Command, args []string) ([]string, []string) {
+	dash := cmd.ArgsLenAtDash()
+	if dash < 0 {
+		return args, nil
+	}
+	return args[:dash], args[dash:]
+}
+
+// parseParams parses the name=value pairs of --param.
+func parseParams(pairs []string) (map[string]string, error) {
+	params := map[string]string{}
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid parameter %q, expected name=value", pair)
+		}
+		params[name] = value
+	}
+	return params, nil
+}
 
+// writeReport prints the failures of a run, if there were any.
+func writeReport(out io.Writer, report *taskgraph.Report) {
+	if report.Empty() {
+		return
+	}
+	fmt.Fprintln(out)
+	report.Write(out)
+}
+
+// writeTimings prints the timing summary of a run.
+func writeTimings(out io.Writer, timings *taskgraph.Timings) {
+	fmt.Fprintln(out)
+	timings.Summary().Write(out)
+}
+
+// printPlan prints the plan of the setup, when it would run, and of the tasks.
+func printPlan(ctx context.Context, out io.Writer, tree *taskgraph.ExecutionTree, taskNames, args []string, withSetup bool) error {
+	if withSetup {
+		plan, err := tree.PlanSetup(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to plan package setup")
+		}
+		writePlan(out, "package setup", plan)
+		fmt.Fprintln(out)
+	}
+	name := strings.Join(taskNames, ", ")
+	plan, err := tree.PlanTasks(taskgraph.WithArgs(ctx, args), taskNames...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to plan %s", name)
+	}
+	return writePlan(out, name, plan)
+}
+
+func writePlan(out io.Writer, name string, plan *taskgraph.Plan) error {
+	hits := 0
+	for _, group := range plan.Groups {
+		for _, step := range group {
+			if step.Cache == taskgraph.CacheHit {
+				hits++
+			}
+		}
+	}
+	fmt.Fprintf(out, "%s: %d tasks in %d groups, %d replayed from the cache\n", name, plan.Steps(), len(plan.Groups), hits)
+	return plan.WriteText(out)
 }
@@ -12,6 +12,8 @@ import (
 
 func createSetupCommand(root *cobra.Command, exec taskgraph.Executor) {
 	force := false
+	jobs := 0
+	keepGoing := false
 
 	SetupCommand := &cobra.Command{
 		Use:   "setup",
@@ -23,7 +25,8 @@ func createSetupCommand(root *cobra.Command, exec taskgraph.Executor) {
 		// },
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cfg := packageconfig.GetConfig()
-			ctx := cfg.ConfigureContext(cmd.Context())
+			ctx := taskgraph.WithJobs(cfg.ConfigureContext(cmd.Context()), jobs)
+			ctx, report := taskgraph.WithReport(taskgraph.WithKeepGoing(ctx, keepGoing))
 			tree, err := taskgraph.CreateTreeFromConfig(cfg, exec)
 			if err != nil {
 				return errors.Wrap(err, "failed to build task tree")
@@ -31,7 +34,9 @@ func createSetupCommand(root *cobra.Command, exec taskgraph.Executor) {
 			if !cfg.WasSetupRun || force {
 				slog.Debug("Looks like this setup was never run, running setup now")
 				fmt.Println("setting up package")
+				cmd.SilenceUsage = true
 				err := tree.RunSetup(ctx)
+				writeReport(cmd.ErrOrStderr(), report)
 				if err != nil {
 					return errors.Wrap(err, "failed to run package setup")
 				}
@@ -47,4 +52,6 @@ func createSetupCommand(root *cobra.Command, exec taskgraph.Executor) {
 
 	root.AddCommand(SetupCommand)
 	SetupCommand.Flags().BoolVarP(&force, "force", "f", false, "Force setup to run, even if not needed")
+	SetupCommand.Flags().BoolVarP(&keepGoing, "keep-going", "k", false, "Keep running every task that does not need a failed one, instead of stopping at the first failure")
+	SetupCommand.Flags().IntVarP(&jobs, "jobs", "j", 0, "How many tasks to run at the same time, defaults to the number of CPUs")
 }
@@ -0,0 +1,206 @@
+package executor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/radding/harbor-runner/internal/cache"
+	"github.com/radding/harbor-runner/internal/fileset"
+	"github.com/radding/harbor-runner/internal/taskgraph"
+)
+
+const artifactManifestKey = "artifacts.json"
+const artifactSubCache = "artifacts"
+
+// errIncompleteEntry is returned when a replayed task is missing some of its
+// cached artifacts.
+var errIncompleteEntry = errors.New("cache entry is incomplete")
+
+// artifactOptions can be declared on any construct, `artifacts` lists the
+// files and directories, relative to the package root, that the task produces.
+type artifactOptions struct {
+	Artifacts []string `json:"artifacts"`
+}
+
+type artifactManifest struct {
+	Files []artifactFile `json:"files"`
+}
+
+type artifactFile struct {
+	Path string      `json:"path"`
+	Mode fs.FileMode `json:"mode"`
+	Key  string      `json:"key"`
+}
+
+// handleArtifacts captures the artifacts of a task that just ran, or restores
+// them when the task was replayed from the cache.
+func handleArtifacts(c cache.Cache, workingDir string, task taskgraph.Task, opts json.RawMessage, resp ExecutionResponse, withCache bool) error {
+	artifacts := artifactOptions{}
+	if len(opts) > 0 {
+		if err := json.Unmarshal(opts, &artifacts); err != nil {
+			return errors.Wrap(err, "failed to parse artifact options")
+		}
+	}
+	for _, artifact := range resp.Artifacts {
+		artifacts.Artifacts = append(artifacts.Artifacts, artifact.Location)
+	}
+	if len(artifacts.Artifacts) == 0 {
+		return nil
+	}
+	if resp.WasCached {
+		restored, err := restoreArtifacts(c, workingDir)
+		if err != nil {
+			return errors.Wrap(err, "failed to restore artifacts")
+		}
+		if !restored {
+			return errors.Wrap(errIncompleteEntry, "no artifacts were captured for the task")
+		}
+		return nil
+	}
+	if !withCache {
+		return nil
+	}
+	return errors.Wrap(captureArtifacts(c, workingDir, artifacts.Artifacts), "failed to capture artifacts")
+}
+
+// artifactPath returns where file, relative to the package root, lives in
+// workingDir. Artifacts outside of the package are refused, a manifest must
+// never make a replay write anywhere else.
+func artifactPath(workingDir, file string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(file))
+	if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("artifact %s is outside of the package", file)
+	}
+	return filepath.Join(workingDir, cleaned), nil
+}
+
+func artifactKey(file string) string {
+	h := sha256.Sum256([]byte(file))
+	return hex.EncodeToString(h[:])
+}
+
+// captureArtifacts snapshots every file matched by patterns into the task's
+// cache so it can be restored when the task is replayed.
+func captureArtifacts(c cache.Cache, workingDir string, patterns []string) error {
+	files := []string{}
+	for _, pattern := range patterns {
+		matches, err := fileset.Glob(workingDir, []string{pattern})
+		if err != nil {
+			return errors.Wrapf(err, "failed to resolve artifact %s", pattern)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("declared artifact %s was not produced", pattern)
+		}
+		files = append(files, matches...)
+	}
+	store, err := c.GetSubCache(artifactSubCache)
+	if err != nil {
+		return errors.Wrap(err, "failed to get artifact cache")
+	}
+	manifest := artifactManifest{
+		Files: []artifactFile{},
+	}
+	for _, file := range files {
+		err := func() error {
+			src, err := artifactPath(workingDir, file)
+			if err != nil {
+				return err
+			}
+			fi, err := os.Open(src)
+			if err != nil {
+				return errors.Wrap(err, "failed to open artifact")
+			}
+			defer fi.Close()
+			info, err := fi.Stat()
+			if err != nil {
+				return errors.Wrap(err, "failed to stat artifact")
+			}
+			key := artifactKey(file)
+			if err := store.Add(key, fi); err != nil {
+				return errors.Wrap(err, "failed to cache artifact")
+			}
+			manifest.Files = append(manifest.Files, artifactFile{
+				Path: file,
+				Mode: info.Mode().Perm(),
+				Key:  key,
+			})
+			return nil
+		}()
+		if err != nil {
+			return errors.Wrapf(err, "failed to capture artifact %s", file)
+		}
+	}
+	bts, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal artifact manifest")
+	}
+	slog.Debug(fmt.Sprintf("captured %d artifacts", len(manifest.Files)))
+	return c.Add(artifactManifestKey, bytes.NewReader(bts))
+}
+
+// restoreArtifacts writes the artifacts captured for a task back into the
+// working tree. It reports false when nothing was captured for the task.
+func restoreArtifacts(c cache.Cache, workingDir string) (bool, error) {
+	buff := new(bytes.Buffer)
+	found, err := c.Get(artifactManifestKey, buff)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read artifact manifest")
+	}
+	if !found {
+		return false, nil
+	}
+	manifest := artifactManifest{}
+	if err := json.Unmarshal(buff.Bytes(), &manifest); err != nil {
+		return false, errors.Wrap(err, "failed to parse artifact manifest")
+	}
+	store, err := c.GetSubCache(artifactSubCache)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get artifact cache")
+	}
+	for _, file := range manifest.Files {
+		if err := restoreArtifact(store, workingDir, file); err != nil {
+			return false, errors.Wrapf(err, "failed to restore artifact %s", file.Path)
+		}
+	}
+	slog.Debug(fmt.Sprintf("restored %d artifacts", len(manifest.Files)))
+	return true, nil
+}
+
+func restoreArtifact(store cache.Cache, workingDir string, file artifactFile) error {
+	dst, err := artifactPath(workingDir, file.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.Wrap(err, "failed to create artifact directory")
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".harbor-artifact-*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary artifact")
+	}
+	defer os.Remove(tmp.Name())
+	found, err := store.Get(file.Key, tmp)
+	closeErr := tmp.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to read artifact from cache")
+	}
+	if closeErr != nil {
+		return errors.Wrap(closeErr, "failed to write artifact")
+	}
+	if !found {
+		return errors.Wrap(errIncompleteEntry, "artifact is missing from the cache")
+	}
+	if err := os.Chmod(tmp.Name(), file.Mode); err != nil {
+		return errors.Wrap(err, "failed to set artifact mode")
+	}
+	return os.Rename(tmp.Name(), dst)
+}
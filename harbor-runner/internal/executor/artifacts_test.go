@@ -0,0 +1,112 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/radding/harbor-runner/internal/cache"
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+	"github.com/radding/harbor-runner/internal/taskgraph"
+	"github.com/stretchr/testify/assert"
+)
+
+// buildElement writes bin/app when produce is set, and like ExecCommand it is
+// replayed whenever its log is cached.
+type buildElement struct {
+	produce bool
+	runs    int
+}
+
+func (b *buildElement) RegisterWith(reg Registery) {
+	reg.Register("test/build", b)
+}
+
+func (b *buildElement) Execute(ctx context.Context, msg ExecutionRequest) (ExecutionResponse, error) {
+	if found, err := cache.Has(msg.Cache, "info.log"); err != nil || found {
+		return ExecutionResponse{WasCached: found}, err
+	}
+	b.runs++
+	if b.produce {
+		if err := os.MkdirAll(filepath.Join(msg.WorkingDir, "bin"), 0755); err != nil {
+			return ExecutionResponse{}, err
+		}
+		if err := os.WriteFile(filepath.Join(msg.WorkingDir, "bin", "app"), []byte("binary"), 0750); err != nil {
+			return ExecutionResponse{}, err
+		}
+	}
+	// the log is cached before the artifacts are captured, like ExecCommand
+	return ExecutionResponse{}, msg.Cache.Add("info.log", strings.NewReader("built"))
+}
+
+// runBuild runs the build task of a fresh tree, like a new harbor run.
+func runBuild(t *testing.T, store *cache.Store, dir string, element *buildElement) error {
+	cfg := packageconfig.NewConfig(store.Root())
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"constructs": {"pkg/build": {"kind": "test/build", "options": {"artifacts": ["bin/app"]}, "dependsOn": []}},
+		"tasks": {"build": "pkg/build"}
+	}`), cfg))
+	tree, err := taskgraph.CreateTreeFromConfig(cfg, New(WithKind("test/build", element)))
+	assert.NoError(t, err)
+	ctx := context.WithValue(cfg.ConfigureContext(context.Background()), packageconfig.WorkingDirCacheKey, dir)
+	return tree.RunTask(ctx, "build")
+}
+
+func TestArtifactsAreRestoredWhenReplayed(t *testing.T) {
+	assert := assert.New(t)
+	store, err := cache.Open(t.TempDir())
+	assert.NoError(err)
+	dir := t.TempDir()
+	element := &buildElement{produce: true}
+
+	assert.NoError(runBuild(t, store, dir, element))
+	assert.NoError(os.RemoveAll(filepath.Join(dir, "bin")))
+	assert.NoError(runBuild(t, store, dir, element))
+	assert.Equal(1, element.runs)
+	bts, err := os.ReadFile(filepath.Join(dir, "bin", "app"))
+	assert.NoError(err)
+	assert.Equal("binary", string(bts))
+	info, err := os.Stat(filepath.Join(dir, "bin", "app"))
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0750), info.Mode().Perm())
+}
+
+func TestMissingArtifactsFailTheTask(t *testing.T) {
+	assert := assert.New(t)
+	store, err := cache.Open(t.TempDir())
+	assert.NoError(err)
+	err = runBuild(t, store, t.TempDir(), &buildElement{})
+	assert.ErrorContains(err, "declared artifact bin/app was not produced")
+}
+
+func TestReplaysWithoutArtifactsRunAgain(t *testing.T) {
+	assert := assert.New(t)
+	store, err := cache.Open(t.TempDir())
+	assert.NoError(err)
+	dir := t.TempDir()
+	element := &buildElement{}
+
+	// the log got cached but capturing the artifacts failed
+	assert.Error(runBuild(t, store, dir, element))
+	element.produce = true
+	assert.NoError(runBuild(t, store, dir, element))
+	assert.Equal(2, element.runs)
+	assert.FileExists(filepath.Join(dir, "bin", "app"))
+}
+
+func TestArtifactsCantLeaveThePackage(t *testing.T) {
+	assert := assert.New(t)
+	root, err := cache.New(t.TempDir())
+	assert.NoError(err)
+	dir := t.TempDir()
+	for _, path := range []string{"../out", "bin/../../out", "/tmp/out"} {
+		_, err := artifactPath(dir, path)
+		assert.ErrorContains(err, "outside of the package", path)
+	}
+	err = restoreArtifact(root, filepath.Join(dir, "pkg"), artifactFile{Path: "../escaped", Key: "key"})
+	assert.ErrorContains(err, "outside of the package")
+	assert.NoFileExists(filepath.Join(dir, "escaped"))
+}
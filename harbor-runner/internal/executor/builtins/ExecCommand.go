@@ -9,9 +9,12 @@ import (
 	"log/slog"
 	"os"
 	"os/exec"
-	"syscall"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/radding/harbor-runner/internal/cache"
 	"github.com/radding/harbor-runner/internal/executor"
 	packageconfig "github.com/radding/harbor-runner/internal/package-config"
 )
@@ -29,14 +32,51 @@ type ExecOptions struct {
 	Args       []string          `json:"args"`
 	Inputs     []string          `json:"inputs"`
 	Env        map[string]string `json:"env"`
+	// Cwd is the directory the command runs in, relative to the package root.
+	Cwd string `json:"cwd"`
+	// Shell is a script run by /bin/sh instead of an executable, it stops at
+	// the first command that fails. Args are the script's positional
+	// parameters.
+	Shell string `json:"shell"`
+	// EnvFiles are .env files, relative to the package root, loaded in order.
+	EnvFiles []string `json:"envFiles"`
+	// CleanEnv starts the command from an empty environment instead of
+	// harbor's, only PATH, HOME and the variables in PassEnv are kept.
+	CleanEnv bool     `json:"cleanEnv"`
+	PassEnv  []string `json:"passEnv"`
+	// Secrets are variables whose values are kept out of the cache key.
+	Secrets []string `json:"secrets"`
+}
+
+// shellPath is the shell scripts run with.
+const shellPath = "/bin/sh"
+
+// command returns the command to run in workingDir, the package root, with
+// extra arguments appended to the ones of the options.
+func (o ExecOptions) command(workingDir string, extra []string) (*exec.Cmd, error) {
+	cwd := filepath.Clean(o.Cwd)
+	if filepath.IsAbs(cwd) || cwd == ".." || strings.HasPrefix(cwd, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("cwd must be inside the package, got %s", o.Cwd)
+	}
+	args := append(slices.Clone(o.Args), extra...)
+	var cmd *exec.Cmd
+	switch {
+	case o.Shell != "" && o.Executable != "":
+		return nil, errors.New("executable and shell can't both be set")
+	case o.Shell != "":
+		// the first argument after the script is $0, like it is for sh
+		cmd = exec.Command(shellPath, append([]string{"-c", "set -e\n" + o.Shell, "harbor"}, args...)...)
+	case o.Executable != "":
+		cmd = exec.Command(o.Executable, args...)
+	default:
+		return nil, errors.New("either executable or shell must be set")
+	}
+	cmd.Dir = filepath.Join(workingDir, cwd)
+	return cmd, nil
 }
 
 func (e *ExecCommand) Execute(ctx context.Context, msg executor.ExecutionRequest) (executor.ExecutionResponse, error) {
-	done := make(chan executor.ExecutionResponse)
 	slog.Debug("starting task", slog.String("working_dir", msg.WorkingDir), slog.String("name", msg.Task.ID))
-	errChan := make(chan error)
-	defer close(errChan)
-	defer close(done)
 
 	opts := ExecOptions{}
 	err := json.Unmarshal(msg.Options, &opts)
@@ -47,27 +87,47 @@ func (e *ExecCommand) Execute(ctx context.Context, msg executor.ExecutionRequest
 
 	taskName := msg.Task.ID
 
-	infoCached, err := msg.Cache.Get("info.log", os.Stdout)
+	// both logs are read before either is replayed, so a task whose entry is
+	// incomplete doesn't print its stale output before running again
+	cachedInfo := new(bytes.Buffer)
+	infoCached, err := msg.Cache.Get("info.log", cachedInfo)
 	if err != nil {
 		return executor.ExecutionResponse{}, errors.Wrap(err, "failed to get from cache")
 	}
-	errorCached, err := msg.Cache.Get("error.log", os.Stderr)
+	cachedError := new(bytes.Buffer)
+	errorCached, err := msg.Cache.Get("error.log", cachedError)
 	if err != nil {
 		return executor.ExecutionResponse{}, errors.Wrap(err, "failed to get error log from cache")
 	}
-	if infoCached || errorCached {
+	if infoCached && errorCached {
+		io.Copy(os.Stdout, cachedInfo)
+		io.Copy(os.Stderr, cachedError)
 		slog.Info("replayed from cache", slog.String("task_name", taskName))
-		return executor.ExecutionResponse{}, nil
+		return executor.ExecutionResponse{
+			WasCached: true,
+		}, nil
+	}
+	if infoCached || errorCached {
+		// both logs are always cached together, the other one was corrupted
+		slog.Warn("cached result is incomplete, running the task again", slog.String("task_name", taskName))
+		if err := msg.Cache.Clean(); err != nil {
+			return executor.ExecutionResponse{}, errors.Wrap(err, "failed to clean incomplete cache entry")
+		}
 	}
 
 	infoBuff := new(bytes.Buffer)
 	errorBuff := new(bytes.Buffer)
-	cmd := exec.Command(opts.Executable, opts.Args...)
-	env := os.Environ()
-	for key, val := range opts.Env {
-		env = append(env, fmt.Sprintf("%s=%s", key, val))
+	cmd, err := opts.command(msg.WorkingDir, msg.Args)
+	if err != nil {
+		return executor.ExecutionResponse{}, errors.Wrap(err, "invalid command")
 	}
-	cmd.Env = env
+	env, err := opts.environment(msg, false)
+	if err != nil {
+		return executor.ExecutionResponse{}, errors.Wrap(err, "failed to compose the environment")
+	}
+	cmd.Env = env.list()
+	startInGroup(cmd)
+	cmd.WaitDelay = pipeWaitDelay
 
 	cmd.Stdout = &PipedLogger{
 		logger: packageconfig.NewPipedLogger(slog.Info, slog.String("task_name", taskName)),
@@ -79,38 +139,48 @@ func (e *ExecCommand) Execute(ctx context.Context, msg executor.ExecutionRequest
 	}
 	err = cmd.Start()
 	if err != nil {
-		slog.Error("failed to start command", slog.String("component", "harbor.dev/ExecCommand"), slog.String("error", err.Error()), slog.String("command", opts.Executable))
+		slog.Error("failed to start command", slog.String("component", "harbor.dev/ExecCommand"), slog.String("error", err.Error()), slog.String("command", cmd.Path))
 		return executor.ExecutionResponse{}, errors.Wrap(err, "failed to start command")
 	}
+	exited := make(chan error, 1)
 	go func() {
-		err := cmd.Wait()
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err := <-exited:
 		if err != nil {
-			slog.Error("failed to run command", slog.String("component", "harbor.dev/ExecCommand"), slog.String("error", err.Error()), slog.String("command", opts.Executable))
-			errChan <- err
-			return
+			slog.Error("failed to run command", slog.String("component", "harbor.dev/ExecCommand"), slog.String("error", err.Error()), slog.String("command", cmd.Path))
+			// the *exec.ExitError is kept so harbor can exit with its code
+			return executor.ExecutionResponse{}, errors.Wrap(err, "failed to execute command")
 		}
-		done <- executor.ExecutionResponse{
-			WasCached: true,
+		msg.Cache.Add("info.log", infoBuff)
+		msg.Cache.Add("error.log", errorBuff)
+		return executor.ExecutionResponse{
+			WasCached: false,
 			Artifacts: []struct {
 				Name     string
 				Location string
 			}{},
 			Error: nil,
-		}
-	}()
-	select {
-	case resp := <-done:
-		msg.Cache.Add("info.log", infoBuff)
-		msg.Cache.Add("error.log", errorBuff)
-		return resp, nil
-	case err := <-errChan:
-		return executor.ExecutionResponse{}, errors.Wrap(err, "failed to execute command")
+		}, nil
 	case <-ctx.Done():
-		cmd.Process.Signal(syscall.SIGINT)
+		terminate(cmd, exited)
 		return executor.ExecutionResponse{}, fmt.Errorf("%s was canceled", msg.Kind)
 	}
 }
 
+// ProbeCache implements executor.CacheProber, a command is replayed when both
+// of its logs are cached.
+func (e *ExecCommand) ProbeCache(ctx context.Context, msg executor.ExecutionRequest) (bool, error) {
+	for _, log := range []string{"info.log", "error.log"} {
+		found, err := cache.Has(msg.Cache, log)
+		if err != nil || !found {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
 type PipedLogger struct {
 	fi     io.Writer
 	logger io.Writer
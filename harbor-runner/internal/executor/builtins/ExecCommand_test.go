@@ -0,0 +1,74 @@
+package builtins
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/radding/harbor-runner/internal/cache"
+	"github.com/radding/harbor-runner/internal/executor"
+	"github.com/radding/harbor-runner/internal/taskgraph"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandsRunInThePackage(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "web"), 0755))
+
+	cmd, err := ExecOptions{Executable: "pwd"}.command(dir, nil)
+	assert.NoError(err)
+	out, err := cmd.Output()
+	assert.NoError(err)
+	assert.Equal(dir, strings.TrimSpace(string(out)))
+
+	cmd, err = ExecOptions{Shell: "pwd; echo \"$@\"", Cwd: "web", Args: []string{"a"}}.command(dir, []string{"b"})
+	assert.NoError(err)
+	out, err = cmd.Output()
+	assert.NoError(err)
+	assert.Equal(filepath.Join(dir, "web")+"\na b\n", string(out))
+
+	cmd, err = ExecOptions{Shell: "false\necho unreachable"}.command(dir, nil)
+	assert.NoError(err)
+	out, err = cmd.Output()
+	assert.Error(err)
+	assert.Empty(out)
+
+	for _, cwd := range []string{"/tmp", "..", "../..", "web/../../other"} {
+		_, err = ExecOptions{Executable: "ls", Cwd: cwd}.command(dir, nil)
+		assert.ErrorContains(err, "cwd must be inside the package", cwd)
+	}
+	_, err = ExecOptions{}.command(dir, nil)
+	assert.ErrorContains(err, "either executable or shell")
+}
+
+func TestIncompleteCacheEntriesAreNotReplayed(t *testing.T) {
+	assert := assert.New(t)
+	c, err := cache.New(t.TempDir())
+	assert.NoError(err)
+	assert.NoError(c.Add("info.log", strings.NewReader("stale output\n")))
+	opts, err := json.Marshal(ExecOptions{Executable: "true"})
+	assert.NoError(err)
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	assert.NoError(err)
+	os.Stdout = w
+	resp, err := (&ExecCommand{}).Execute(context.Background(), executor.ExecutionRequest{
+		Cache:      c,
+		WorkingDir: t.TempDir(),
+		Options:    opts,
+		Task:       taskgraph.Task{ID: "build"},
+	})
+	os.Stdout = stdout
+	w.Close()
+	assert.NoError(err)
+	assert.False(resp.WasCached)
+	replayed, err := io.ReadAll(r)
+	assert.NoError(err)
+	assert.NotContains(string(replayed), "stale output")
+}
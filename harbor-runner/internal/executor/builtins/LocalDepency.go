@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"os"
 	"path"
+	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/radding/harbor-runner/internal/executor"
@@ -24,6 +25,7 @@ type localDependency struct {
 }
 
 type LocalDependencyManager struct {
+	mu     sync.Mutex
 	locals map[string]*localDependency
 }
 
@@ -34,25 +36,41 @@ func (l *LocalDependencyManager) Execute(ctx context.Context, msg executor.Execu
 	if err != nil {
 		return executor.ExecutionResponse{}, errors.Wrap(err, "failed to unmarshal JSON")
 	}
+	_, err = l.load(opts.Path, msg.Task.GetExecutor())
+	if err != nil {
+		return executor.ExecutionResponse{}, err
+	}
+	return executor.ExecutionResponse{}, nil
+}
+
+// load returns the local dependency at depPath, loading its config and task
+// graph the first time it is asked for.
+func (l *LocalDependencyManager) load(depPath string, exec taskgraph.Executor) (*localDependency, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if dep, ok := l.locals[depPath]; ok {
+		return dep, nil
+	}
 	wd, err := os.Getwd()
 	if err != nil {
-		return executor.ExecutionResponse{}, errors.Wrap(err, "failed to get working directory")
+		return nil, errors.Wrap(err, "failed to get working directory")
 	}
-	pth := path.Join(wd, opts.Path, "./.harborrc.ts")
+	pth := path.Join(wd, depPath, "./.harborrc.ts")
 	slog.Debug("attempting to load config", slog.String("locaation", pth))
 	conf, err := packageconfig.LoadConfig(pth)
 	if err != nil {
-		return executor.ExecutionResponse{}, errors.Wrap(err, "failed to load config for local dependency")
+		return nil, errors.Wrap(err, "failed to load config for local dependency")
 	}
-	tree, err := taskgraph.CreateTreeFromConfig(&conf, msg.Task.GetExecutor())
+	tree, err := taskgraph.CreateTreeFromConfig(&conf, exec)
 	if err != nil {
-		return executor.ExecutionResponse{}, errors.Wrap(err, "failed to get task graph for local dep")
+		return nil, errors.Wrap(err, "failed to get task graph for local dep")
 	}
-	l.locals[opts.Path] = &localDependency{
+	dep := &localDependency{
 		taskGraph: tree,
 		config:    &conf,
 	}
-	return executor.ExecutionResponse{}, nil
+	l.locals[depPath] = dep
+	return dep, nil
 }
 
 func (n *LocalDependencyManager) RegisterWith(reg executor.Registery) {
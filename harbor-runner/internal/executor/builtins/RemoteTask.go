@@ -6,6 +6,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/radding/harbor-runner/internal/executor"
+	"github.com/radding/harbor-runner/internal/taskgraph"
 )
 
 type RemoteExecutor struct {
@@ -17,7 +18,7 @@ type remoteExecutorOptions struct {
 	Run        string                 `json:"run"`
 	IsDepLocal bool                   `json:"isDepenedencyLocal"`
 	Artifacts  []string               `json:"artifacts"`
-	Inputs     []string               `json:"string"`
+	Inputs     []string               `json:"inputs"`
 }
 
 func (l *RemoteExecutor) Execute(ctx context.Context, msg executor.ExecutionRequest) (executor.ExecutionResponse, error) {
@@ -29,12 +30,16 @@ func (l *RemoteExecutor) Execute(ctx context.Context, msg executor.ExecutionRequ
 	}
 
 	if opts.IsDepLocal {
-		dep, ok := l.localDeps.locals[opts.Dependency.Path]
-		if !ok {
-			return executor.ExecutionResponse{}, errors.Errorf("did not load local depenedency at %s", opts.Dependency.Path)
+		dep, err := l.localDeps.load(opts.Dependency.Path, msg.Task.GetExecutor())
+		if err != nil {
+			return executor.ExecutionResponse{}, errors.Wrapf(err, "did not load local depenedency at %s", opts.Dependency.Path)
+		}
+		ctx, err = taskgraph.EnterDependencyTask(ctx, msg.Task.ID, dep.config, opts.Run)
+		if err != nil {
+			return executor.ExecutionResponse{}, err
 		}
 		ctx = dep.config.ConfigureContext(ctx)
-		err := dep.taskGraph.RunTask(ctx, opts.Run)
+		err = dep.taskGraph.RunTask(ctx, opts.Run)
 		if err != nil {
 			return executor.ExecutionResponse{}, errors.Wrap(err, "failed to run task")
 		}
@@ -43,6 +48,51 @@ func (l *RemoteExecutor) Execute(ctx context.Context, msg executor.ExecutionRequ
 	return executor.ExecutionResponse{}, errors.New("not implemented")
 }
 
+// Fingerprint implements executor.Fingerprinter. A task of a local dependency
+// is only as fresh as that dependency's own task graph, so its key is folded
+// into ours.
+func (l *RemoteExecutor) Fingerprint(ctx context.Context, msg executor.ExecutionRequest) (string, error) {
+	opts := &remoteExecutorOptions{}
+	err := json.Unmarshal(msg.Options, opts)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get options for remote task")
+	}
+	if !opts.IsDepLocal {
+		return "", nil
+	}
+	dep, err := l.localDeps.load(opts.Dependency.Path, msg.Task.GetExecutor())
+	if err != nil {
+		return "", err
+	}
+	ctx, err = taskgraph.EnterDependencyTask(ctx, msg.Task.ID, dep.config, opts.Run)
+	if err != nil {
+		return "", err
+	}
+	return dep.taskGraph.TaskKey(dep.config.ConfigureContext(ctx), opts.Run)
+}
+
+// ResolveDependency implements executor.DependencyResolver.
+func (l *RemoteExecutor) ResolveDependency(ctx context.Context, msg executor.ExecutionRequest) (*taskgraph.Dependency, error) {
+	opts := &remoteExecutorOptions{}
+	err := json.Unmarshal(msg.Options, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get options for remote task")
+	}
+	if !opts.IsDepLocal {
+		return nil, nil
+	}
+	dep, err := l.localDeps.load(opts.Dependency.Path, msg.Task.GetExecutor())
+	if err != nil {
+		return nil, err
+	}
+	return &taskgraph.Dependency{
+		Name:   opts.Dependency.Path,
+		Config: dep.config,
+		Tree:   dep.taskGraph,
+		Task:   opts.Run,
+	}, nil
+}
+
 func (n *RemoteExecutor) RegisterWith(reg executor.Registery) {
 	reg.Register("harbor.dev/RemoteTask", n)
 }
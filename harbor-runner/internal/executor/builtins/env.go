@@ -0,0 +1,228 @@
+package builtins
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/radding/harbor-runner/internal/executor"
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+)
+
+// cleanEnvDefaults are the variables of harbor's environment a clean
+// environment still has, commands can hardly run without them.
+var cleanEnvDefaults = []string{"PATH", "HOME"}
+
+// secretPlaceholder stands in for the value of a secret in the cache key.
+const secretPlaceholder = "<secret>"
+
+// variableReference matches the ${NAME} references interpolated in values,
+// a lone $ is left alone so values like passwords don't need escaping.
+var variableReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// environment is a set of variables that remembers the order they were set in.
+type environment struct {
+	names  []string
+	values map[string]string
+}
+
+func newEnvironment() *environment {
+	return &environment{
+		values: map[string]string{},
+	}
+}
+
+func (e *environment) set(name, value string) {
+	if _, ok := e.values[name]; !ok {
+		e.names = append(e.names, name)
+	}
+	e.values[name] = value
+}
+
+// list returns the variables as NAME=value.
+func (e *environment) list() []string {
+	list := make([]string, 0, len(e.names))
+	for _, name := range e.names {
+		list = append(list, fmt.Sprintf("%s=%s", name, e.values[name]))
+	}
+	return list
+}
+
+// hostEnvironment is harbor's own environment.
+func hostEnvironment() map[string]string {
+	host := map[string]string{}
+	for _, variable := range os.Environ() {
+		name, value, _ := strings.Cut(variable, "=")
+		host[name] = value
+	}
+	return host
+}
+
+// builtinVariables are the variables values can reference on top of the
+// environment.
+func builtinVariables(msg executor.ExecutionRequest) map[string]string {
+	harborCache := filepath.Join(msg.WorkingDir, ".harbor")
+	if msg.Config != nil && msg.Config.GetStore() != nil {
+		harborCache = msg.Config.GetStore().Base()
+	}
+	return map[string]string{
+		"PACKAGE_ROOT": msg.WorkingDir,
+		"HARBOR_CACHE": harborCache,
+	}
+}
+
+// environment composes the environment of the command, each layer overriding
+// the ones before it: harbor's environment, or only the allowed part of it
+// when the command wants a clean one, the package's env, the env files in
+// order, the command's env and the run's parameters. Values may reference
+// ${PACKAGE_ROOT}, ${HARBOR_CACHE} and any variable set before them.
+//
+// forKey composes what goes into the cache key instead: only the variables
+// harbor sets, with the package paths left as references and the values of
+// secrets left out, so the key is the same on every machine.
+func (o ExecOptions) environment(msg executor.ExecutionRequest, forKey bool) (*environment, error) {
+	host := hostEnvironment()
+	builtins := builtinVariables(msg)
+	secrets := map[string]bool{}
+	for _, name := range o.Secrets {
+		secrets[name] = true
+	}
+	env := newEnvironment()
+	if !forKey {
+		for _, variable := range os.Environ() {
+			name, value, _ := strings.Cut(variable, "=")
+			if !o.CleanEnv || slices.Contains(cleanEnvDefaults, name) || slices.Contains(o.PassEnv, name) {
+				env.set(name, value)
+			}
+		}
+	}
+	lookup := func(name string) string {
+		if _, ok := builtins[name]; ok && forKey {
+			return fmt.Sprintf("${%s}", name)
+		}
+		if secrets[name] && forKey {
+			return secretPlaceholder
+		}
+		if value, ok := builtins[name]; ok {
+			return value
+		}
+		if value, ok := env.values[name]; ok {
+			return value
+		}
+		return host[name]
+	}
+	interpolate := func(value string) string {
+		return variableReference.ReplaceAllStringFunc(value, func(reference string) string {
+			return lookup(variableReference.FindStringSubmatch(reference)[1])
+		})
+	}
+	// variables of a map are set together, they can only reference the ones
+	// set before the map
+	setAll := func(variables map[string]string) {
+		names := make([]string, 0, len(variables))
+		for name := range variables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		resolved := map[string]string{}
+		for _, name := range names {
+			resolved[name] = interpolate(variables[name])
+		}
+		for _, name := range names {
+			env.set(name, resolved[name])
+		}
+	}
+
+	if msg.Config != nil {
+		setAll(msg.Config.PackageInfo.Env)
+	}
+	for _, fileName := range o.EnvFiles {
+		variables, err := readEnvFile(filepath.Join(msg.WorkingDir, fileName))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load env file %s", fileName)
+		}
+		for _, variable := range variables {
+			env.set(variable[0], interpolate(variable[1]))
+		}
+	}
+	setAll(o.Env)
+	if forKey {
+		for _, name := range o.Secrets {
+			if _, ok := env.values[name]; ok {
+				env.values[name] = secretPlaceholder
+			}
+		}
+		return env, nil
+	}
+	for _, variable := range packageconfig.ParamsEnv(msg.Params) {
+		name, value, _ := strings.Cut(variable, "=")
+		env.set(name, value)
+	}
+	return env, nil
+}
+
+// readEnvFile reads the NAME=value lines of a .env file in order. Blank lines
+// and lines starting with # are skipped, an `export ` prefix is allowed and
+// values may be quoted.
+func readEnvFile(fileName string) ([][2]string, error) {
+	fi, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	variables := [][2]string{}
+	scanner := bufio.NewScanner(fi)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+		name, value, ok := strings.Cut(text, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d is not NAME=value", line)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = strings.ReplaceAll(value[1:len(value)-1], `\n`, "\n")
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		variables = append(variables, [2]string{name, value})
+	}
+	return variables, scanner.Err()
+}
+
+// Fingerprint implements executor.Fingerprinter. The environment harbor sets
+// for the command is part of its cache key, secrets aside.
+func (e *ExecCommand) Fingerprint(ctx context.Context, msg executor.ExecutionRequest) (string, error) {
+	opts := ExecOptions{}
+	if err := json.Unmarshal(msg.Options, &opts); err != nil {
+		return "", errors.Wrap(err, "failed to parse options JSON")
+	}
+	env, err := opts.environment(msg, true)
+	if err != nil {
+		return "", err
+	}
+	if len(env.names) == 0 {
+		return "", nil
+	}
+	list := env.list()
+	sort.Strings(list)
+	h := sha256.New()
+	for _, variable := range list {
+		fmt.Fprintln(h, variable)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
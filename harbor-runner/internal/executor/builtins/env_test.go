@@ -0,0 +1,66 @@
+package builtins
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/radding/harbor-runner/internal/executor"
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvironmentLayersAndInterpolates(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	t.Setenv("HARBOR_TEST_HOST", "host")
+	t.Setenv("HARBOR_TEST_PASSED", "passed")
+	assert.NoError(os.WriteFile(filepath.Join(dir, ".env"), []byte("# local\nexport TOKEN='s3cr$t'\nAUTH=\"Bearer ${TOKEN}\"\nSTAGE=file\n"), 0644))
+	cfg := &packageconfig.Config{}
+	cfg.PackageInfo.Env = map[string]string{"STAGE": "package", "OUT": "${PACKAGE_ROOT}/dist"}
+	msg := executor.ExecutionRequest{WorkingDir: dir, Config: cfg, Params: map[string]string{"shards": "2"}}
+	opts := ExecOptions{
+		EnvFiles: []string{".env"},
+		Env:      map[string]string{"HOME_COPY": "${HARBOR_TEST_HOST}", "STAGE": "${STAGE}-task"},
+		CleanEnv: true,
+		PassEnv:  []string{"HARBOR_TEST_PASSED"},
+		Secrets:  []string{"TOKEN"},
+	}
+
+	env, err := opts.environment(msg, false)
+	assert.NoError(err)
+	assert.Equal("passed", env.values["HARBOR_TEST_PASSED"])
+	assert.NotContains(env.values, "HARBOR_TEST_HOST")
+	assert.Equal(filepath.Join(dir, "dist"), env.values["OUT"])
+	assert.Equal("s3cr$t", env.values["TOKEN"])
+	assert.Equal("Bearer s3cr$t", env.values["AUTH"])
+	assert.Equal("file-task", env.values["STAGE"])
+	assert.Equal("host", env.values["HOME_COPY"])
+	assert.Contains(env.values, packageconfig.ParamsEnvVar)
+
+	env, err = opts.environment(msg, true)
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"OUT":       "${PACKAGE_ROOT}/dist",
+		"TOKEN":     secretPlaceholder,
+		"AUTH":      "Bearer " + secretPlaceholder,
+		"STAGE":     "file-task",
+		"HOME_COPY": "host",
+	}, env.values)
+
+	// the key follows the environment but not the secrets
+	bts, _ := json.Marshal(opts)
+	msg.Options = bts
+	before, err := (&ExecCommand{}).Fingerprint(context.Background(), msg)
+	assert.NoError(err)
+	assert.NoError(os.WriteFile(filepath.Join(dir, ".env"), []byte("TOKEN=rotated\nAUTH=\"Bearer ${TOKEN}\"\nSTAGE=file\n"), 0644))
+	after, err := (&ExecCommand{}).Fingerprint(context.Background(), msg)
+	assert.NoError(err)
+	assert.Equal(before, after)
+	assert.NoError(os.WriteFile(filepath.Join(dir, ".env"), []byte("TOKEN=rotated\nSTAGE=other\n"), 0644))
+	after, err = (&ExecCommand{}).Fingerprint(context.Background(), msg)
+	assert.NoError(err)
+	assert.NotEqual(before, after)
+}
@@ -0,0 +1,44 @@
+package builtins
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// terminationStep is a signal sent to a cancelled command and how long the
+// command then has to exit before the next step.
+type terminationStep struct {
+	signal os.Signal
+	grace  time.Duration
+}
+
+// terminationSteps escalate from asking a command to stop to killing it.
+var terminationSteps = []terminationStep{
+	{signal: syscall.SIGINT, grace: 10 * time.Second},
+	{signal: syscall.SIGTERM, grace: 5 * time.Second},
+	{signal: syscall.SIGKILL, grace: 5 * time.Second},
+}
+
+// pipeWaitDelay is how long a command's output is still read once it exited,
+// processes it started may hold on to its output.
+const pipeWaitDelay = 5 * time.Second
+
+// terminate stops a command that was started in its own process group,
+// signalling the whole group until exited says the command is gone.
+func terminate(cmd *exec.Cmd, exited <-chan error) {
+	for _, step := range terminationSteps {
+		slog.Debug("stopping command", slog.String("command", cmd.Path), slog.String("signal", step.signal.String()))
+		if err := signalGroup(cmd, step.signal); err != nil {
+			slog.Debug("failed to signal command", slog.String("command", cmd.Path), slog.String("error", err.Error()))
+		}
+		select {
+		case <-exited:
+			return
+		case <-time.After(step.grace):
+		}
+	}
+	slog.Warn("command did not stop after being killed", slog.String("command", cmd.Path))
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package builtins
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Process groups are only used on unix, elsewhere only the command itself is
+// stopped and it is killed right away.
+func startInGroup(cmd *exec.Cmd) {}
+
+func signalGroup(cmd *exec.Cmd, sig os.Signal) error {
+	return cmd.Process.Kill()
+}
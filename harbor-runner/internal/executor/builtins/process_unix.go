@@ -0,0 +1,20 @@
+//go:build unix
+
+package builtins
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// startInGroup makes cmd the leader of a process group of its own, so the
+// processes it starts can be signalled along with it.
+func startInGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalGroup sends sig to every process in the group of cmd.
+func signalGroup(cmd *exec.Cmd, sig os.Signal) error {
+	return syscall.Kill(-cmd.Process.Pid, sig.(syscall.Signal))
+}
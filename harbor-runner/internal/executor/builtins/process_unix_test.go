@@ -0,0 +1,73 @@
+//go:build unix
+
+package builtins
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/radding/harbor-runner/internal/application"
+	"github.com/radding/harbor-runner/internal/cache"
+	"github.com/radding/harbor-runner/internal/executor"
+	"github.com/stretchr/testify/assert"
+)
+
+func shellRequest(t *testing.T, dir, script string) executor.ExecutionRequest {
+	opts, err := json.Marshal(ExecOptions{Shell: script})
+	assert.NoError(t, err)
+	return executor.ExecutionRequest{
+		Kind:       "harbor.dev/ExecCommand",
+		Cache:      &cache.NonCache{},
+		WorkingDir: dir,
+		Options:    opts,
+	}
+}
+
+func TestCancelledCommandsStopTheirWholeGroup(t *testing.T) {
+	assert := assert.New(t)
+	steps := terminationSteps
+	defer func() { terminationSteps = steps }()
+	terminationSteps = []terminationStep{
+		{signal: syscall.SIGINT, grace: 100 * time.Millisecond},
+		{signal: syscall.SIGTERM, grace: 100 * time.Millisecond},
+		{signal: syscall.SIGKILL, grace: time.Second},
+	}
+
+	dir := t.TempDir()
+	// the shell ignores the first signals, its child does not
+	script := "trap '' INT TERM; sleep 60 & echo $! > child.pid; wait"
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		cancel()
+	}()
+	started := time.Now()
+	_, err := (&ExecCommand{}).Execute(ctx, shellRequest(t, dir, script))
+	assert.ErrorContains(err, "was canceled")
+	assert.Less(time.Since(started), 5*time.Second)
+
+	bts, err := os.ReadFile(filepath.Join(dir, "child.pid"))
+	assert.NoError(err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bts)))
+	assert.NoError(err)
+	assert.Eventually(func() bool {
+		status, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "status"))
+		// gone, or a zombie nobody reaped yet
+		return err != nil || strings.Contains(string(status), "State:\tZ")
+	}, 2*time.Second, 50*time.Millisecond)
+}
+
+func TestFailedCommandsKeepTheirExitCode(t *testing.T) {
+	assert := assert.New(t)
+	_, err := (&ExecCommand{}).Execute(context.Background(), shellRequest(t, t.TempDir(), "exit 3"))
+	assert.Error(err)
+	assert.Equal(3, application.ExitCode(errors.Wrap(err, "failed to run test")))
+}
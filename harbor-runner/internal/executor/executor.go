@@ -32,6 +32,13 @@ type ExecutionRequest struct {
 	WorkspaceRoot string
 	Options       json.RawMessage
 	Task          taskgraph.Task
+	// Args are the extra arguments of the run, only the tasks the run was
+	// asked for get them.
+	Args []string
+	// Params are the parameters of the run, defaults included.
+	Params map[string]string
+	// Config is the config of the task's package.
+	Config *packageconfig.Config
 }
 
 type ExecutionElement interface {
@@ -39,10 +46,35 @@ type ExecutionElement interface {
 	RegisterWith(reg Registery)
 }
 
+// Fingerprinter is implemented by execution elements whose results depend on
+// more than their options, the returned fingerprint is mixed into the task's
+// cache key.
+type Fingerprinter interface {
+	Fingerprint(ctx context.Context, msg ExecutionRequest) (string, error)
+}
+
+// DependencyResolver is implemented by execution elements that run tasks of
+// other packages.
+type DependencyResolver interface {
+	ResolveDependency(ctx context.Context, msg ExecutionRequest) (*taskgraph.Dependency, error)
+}
+
+// CacheProber is implemented by execution elements that replay their results
+// from the cache, it tells whether msg.Cache holds a complete result.
+type CacheProber interface {
+	ProbeCache(ctx context.Context, msg ExecutionRequest) (bool, error)
+}
+
 type Registery interface {
 	Register(kind string, elem ExecutionElement)
 }
 
+type executorContextKeyType string
+
+// _HEALING_CONTEXT_KEY marks a task that is being re-run because its cached
+// result was incomplete, it is only ever re-run once.
+const _HEALING_CONTEXT_KEY = executorContextKeyType("HEALING")
+
 type executor struct {
 	executors map[string]ExecutionElement
 }
@@ -65,6 +97,9 @@ type ExecutionOption func(e *ExecutorOptions) *ExecutorOptions
 
 type Executor interface {
 	taskgraph.Executor
+	taskgraph.Fingerprinter
+	taskgraph.DependencyResolver
+	taskgraph.CacheProber
 	application.Initializer
 	Accept(exec ExecutionElement)
 }
@@ -119,6 +154,10 @@ func (e *executor) Execute(ctx context.Context, kind string, opts json.RawMessag
 	if !ok {
 		slog.Warn("not in a workspace")
 	}
+	cfg, err := packageconfig.ExtractConfigFromContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to execute %s", kind)
+	}
 	executor, ok := e.executors[kind]
 	if !ok {
 		return fmt.Errorf("no executor for kind %s", kind)
@@ -132,16 +171,133 @@ func (e *executor) Execute(ctx context.Context, kind string, opts json.RawMessag
 		WorkspaceRoot: workspaceRoot,
 		Options:       opts,
 		Task:          task,
+		Args:          taskgraph.GetArgsFromContext(ctx),
+		Params:        cfg.ParamValues(),
+		Config:        cfg,
 	})
 	if err != nil {
 		return err
 	}
 	if resp.Error != nil {
-		return errors.Wrap(err, "failed to execute")
+		return errors.Wrap(resp.Error, "failed to execute")
 	}
 
-	if len(resp.Artifacts) > 0 {
-		slog.Debug("Here I will move artifacts")
+	err = handleArtifacts(cache, workingDir, task, opts, resp, withCache)
+	if resp.WasCached && errors.Cause(err) == errIncompleteEntry && ctx.Value(_HEALING_CONTEXT_KEY) == nil {
+		slog.Warn("cached result is incomplete, running the task again", slog.String("task_id", task.ID), slog.String("error", err.Error()))
+		if err := cache.Clean(); err != nil {
+			return errors.Wrap(err, "failed to clean incomplete cache entry")
+		}
+		return e.Execute(context.WithValue(ctx, _HEALING_CONTEXT_KEY, true), kind, opts)
+	}
+	if err != nil {
+		return err
+	}
+	if withCache {
+		recordRun(ctx, cache, resp.WasCached)
+	}
+	if resp.WasCached {
+		taskgraph.MarkReplayed(ctx)
 	}
 	return nil
 }
+
+// recordRun keeps the hit and miss statistics shown by `harbor cache info`.
+func recordRun(ctx context.Context, c cache.Cache, wasCached bool) {
+	recorder, ok := c.(cache.StatsRecorder)
+	if !ok {
+		return
+	}
+	var keyInputs json.RawMessage
+	if inputs, ok := taskgraph.GetKeyInputsFromContext(ctx); ok {
+		bts, err := json.Marshal(inputs)
+		if err == nil {
+			keyInputs = bts
+		}
+	}
+	if err := recorder.RecordRun(wasCached, keyInputs); err != nil {
+		slog.Debug("failed to record cache statistics", slog.String("error", err.Error()))
+	}
+}
+
+func (e *executor) Fingerprint(ctx context.Context, kind string, opts json.RawMessage) (string, error) {
+	executor, ok := e.executors[kind]
+	if !ok {
+		return "", fmt.Errorf("no executor for kind %s", kind)
+	}
+	fingerprinter, ok := executor.(Fingerprinter)
+	if !ok {
+		return "", nil
+	}
+	workingDir, ok := ctx.Value(packageconfig.WorkingDirCacheKey).(string)
+	if !ok {
+		return "", fmt.Errorf("failed to fingerprint %s. Working location not in context", kind)
+	}
+	task, err := taskgraph.GetTaskFromContext(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get task from context")
+	}
+	// the config is only missing for tasks outside of a package
+	cfg, _ := packageconfig.ExtractConfigFromContext(ctx)
+	return fingerprinter.Fingerprint(ctx, ExecutionRequest{
+		Kind:       kind,
+		WorkingDir: workingDir,
+		Options:    opts,
+		Task:       task,
+		Config:     cfg,
+	})
+}
+
+func (e *executor) ResolveDependency(ctx context.Context, kind string, opts json.RawMessage) (*taskgraph.Dependency, error) {
+	executor, ok := e.executors[kind]
+	if !ok {
+		return nil, fmt.Errorf("no executor for kind %s", kind)
+	}
+	resolver, ok := executor.(DependencyResolver)
+	if !ok {
+		return nil, nil
+	}
+	task, err := taskgraph.GetTaskFromContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get task from context")
+	}
+	return resolver.ResolveDependency(ctx, ExecutionRequest{
+		Kind:    kind,
+		Options: opts,
+		Task:    task,
+	})
+}
+
+func (e *executor) ProbeCache(ctx context.Context, kind string, opts json.RawMessage) (taskgraph.CacheStatus, error) {
+	executor, ok := e.executors[kind]
+	if !ok {
+		return "", fmt.Errorf("no executor for kind %s", kind)
+	}
+	prober, ok := executor.(CacheProber)
+	if !ok {
+		return taskgraph.NotCached, nil
+	}
+	cache, ok := ctx.Value(cache.CacheContextKeyValue).(cache.Cache)
+	if !ok {
+		return "", fmt.Errorf("failed to check the cache of %s. Cache not in context", kind)
+	}
+	task, err := taskgraph.GetTaskFromContext(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get task from context")
+	}
+	workingDir, _ := ctx.Value(packageconfig.WorkingDirCacheKey).(string)
+	hit, err := prober.ProbeCache(ctx, ExecutionRequest{
+		Kind:       kind,
+		Cache:      cache,
+		WorkingDir: workingDir,
+		Options:    opts,
+		Task:       task,
+	})
+	if err != nil {
+		return "", err
+	}
+	if hit {
+		return taskgraph.CacheHit, nil
+	}
+	return taskgraph.CacheMiss, nil
+}
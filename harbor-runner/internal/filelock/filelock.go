@@ -0,0 +1,62 @@
+// Package filelock provides advisory locks on files, used to keep separate
+// harbor processes working in the same package from stepping on each other.
+package filelock
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Lock is an exclusive advisory lock held on a file. It excludes other
+// processes as well as other goroutines of this process locking the same file.
+type Lock struct {
+	file *os.File
+	mu   *sync.Mutex
+}
+
+// locks serializes goroutines of this process, not every platform excludes
+// two locks taken by the same process.
+var locks sync.Map
+
+// Acquire blocks until it holds the lock on fileName, creating the file if it
+// does not exist.
+func Acquire(fileName string) (*Lock, error) {
+	abs, err := filepath.Abs(fileName)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve lock file")
+	}
+	mu, _ := locks.LoadOrStore(abs, &sync.Mutex{})
+	l := &Lock{
+		mu: mu.(*sync.Mutex),
+	}
+	l.mu.Lock()
+	if err := os.MkdirAll(filepath.Dir(abs), 0744); err != nil {
+		l.mu.Unlock()
+		return nil, errors.Wrap(err, "failed to make lock dir")
+	}
+	l.file, err = os.OpenFile(abs, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		l.mu.Unlock()
+		return nil, errors.Wrap(err, "failed to open lock file")
+	}
+	if err := lockFile(l.file); err != nil {
+		l.file.Close()
+		l.mu.Unlock()
+		return nil, errors.Wrapf(err, "failed to lock %s", abs)
+	}
+	return l, nil
+}
+
+// Release gives up the lock.
+func (l *Lock) Release() error {
+	defer l.mu.Unlock()
+	err := unlockFile(l.file)
+	closeErr := l.file.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to unlock file")
+	}
+	return errors.Wrap(closeErr, "failed to close lock file")
+}
@@ -0,0 +1,75 @@
+package filelock
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcquireSerializesGoroutines(t *testing.T) {
+	assert := assert.New(t)
+	fileName := filepath.Join(t.TempDir(), "counter.lock")
+	counter := 0
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, err := Acquire(fileName)
+			if !assert.NoError(err) {
+				return
+			}
+			current := counter
+			time.Sleep(time.Millisecond)
+			counter = current + 1
+			assert.NoError(l.Release())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(20, counter)
+}
+
+// TestHelperProcess is run by TestAcquireExcludesOtherProcesses in a child
+// process, it records when it managed to take the lock.
+func TestHelperProcess(t *testing.T) {
+	fileName := os.Getenv("FILELOCK_HELPER_LOCK")
+	if fileName == "" {
+		return
+	}
+	l, err := Acquire(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Release()
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := os.WriteFile(fileName+".acquired", []byte(now), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquireExcludesOtherProcesses(t *testing.T) {
+	assert := assert.New(t)
+	fileName := filepath.Join(t.TempDir(), "process.lock")
+	l, err := Acquire(fileName)
+	assert.NoError(err)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(), "FILELOCK_HELPER_LOCK="+fileName)
+	assert.NoError(cmd.Start())
+	time.Sleep(200 * time.Millisecond)
+	released := time.Now()
+	assert.NoError(l.Release())
+	assert.NoError(cmd.Wait())
+
+	bts, err := os.ReadFile(fileName + ".acquired")
+	assert.NoError(err)
+	acquired, err := strconv.ParseInt(string(bts), 10, 64)
+	assert.NoError(err)
+	assert.GreaterOrEqual(acquired, released.UnixNano())
+}
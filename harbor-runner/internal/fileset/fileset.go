@@ -0,0 +1,141 @@
+// Package fileset resolves the glob patterns constructs use to declare files,
+// such as their inputs, into the concrete files they refer to.
+package fileset
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// skippedDirs are never descended into while walking, the harbor cache would
+// otherwise feed back into the inputs of every task.
+var skippedDirs = map[string]bool{
+	".harbor": true,
+	".git":    true,
+}
+
+// Glob returns every file under root matched by one of patterns. Patterns are
+// slash separated and relative to root, `**` matches any number of directories
+// and a pattern matching a directory matches everything inside of it. The
+// result is sorted, de-duplicated and relative to root.
+func Glob(root string, patterns []string) ([]string, error) {
+	seen := map[string]bool{}
+	files := []string{}
+	for _, pattern := range patterns {
+		matches, err := glob(root, pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve pattern %q", pattern)
+		}
+		for _, match := range matches {
+			if seen[match] {
+				continue
+			}
+			seen[match] = true
+			files = append(files, match)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func glob(root, pattern string) ([]string, error) {
+	pattern = path.Clean(filepath.ToSlash(pattern))
+	if path.IsAbs(pattern) || pattern == ".." || strings.HasPrefix(pattern, "../") {
+		return nil, errors.New("pattern must be relative to the package root")
+	}
+	segments := strings.Split(pattern, "/")
+	static := 0
+	for static < len(segments) && !hasMeta(segments[static]) {
+		static++
+	}
+	base := path.Join(segments[:static]...)
+	rest := segments[static:]
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	baseDir := filepath.Join(root, filepath.FromSlash(base))
+	info, err := os.Stat(baseDir)
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to stat pattern base")
+	}
+	if !info.IsDir() {
+		if len(rest) == 0 {
+			return []string{base}, nil
+		}
+		return nil, nil
+	}
+
+	matches := []string{}
+	err = filepath.WalkDir(baseDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != baseDir && skippedDirs[d.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(baseDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if len(rest) == 0 || matchAnyPrefix(rest, strings.Split(rel, "/")) {
+			matches = append(matches, path.Join(base, rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to walk pattern base")
+	}
+	return matches, nil
+}
+
+func hasMeta(segment string) bool {
+	return strings.ContainsAny(segment, `*?[\`)
+}
+
+// matchAnyPrefix reports whether pattern matches name or one of the
+// directories containing it.
+func matchAnyPrefix(pattern, name []string) bool {
+	for i := len(name); i > 0; i-- {
+		if matchSegments(pattern, name[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], name[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
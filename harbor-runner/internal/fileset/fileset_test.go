@@ -0,0 +1,66 @@
+package fileset
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFiles(t *testing.T, root string, files ...string) {
+	for _, file := range files {
+		full := filepath.Join(root, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGlob(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root,
+		"go.mod",
+		"cmd/harbor/main.go",
+		"internal/cache/cache.go",
+		"internal/cache/cache_test.go",
+		"internal/templates/info.tmpl",
+		".harbor/abc/info.log",
+	)
+
+	cases := []struct {
+		name     string
+		patterns []string
+		expected []string
+	}{
+		{"plain file", []string{"go.mod"}, []string{"go.mod"}},
+		{"star", []string{"internal/cache/*.go"}, []string{"internal/cache/cache.go", "internal/cache/cache_test.go"}},
+		{"double star", []string{"**/*.go"}, []string{"cmd/harbor/main.go", "internal/cache/cache.go", "internal/cache/cache_test.go"}},
+		{"directory", []string{"internal/templates"}, []string{"internal/templates/info.tmpl"}},
+		{"dedupes", []string{"go.mod", "./go.mod"}, []string{"go.mod"}},
+		{"missing", []string{"nope/**"}, []string{}},
+		{"skips harbor cache", []string{"**/*.log"}, []string{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			files, err := Glob(root, c.patterns)
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, files)
+		})
+	}
+}
+
+func TestGlobRejectsAbsolutePatterns(t *testing.T) {
+	_, err := Glob(t.TempDir(), []string{"/etc/passwd"})
+	assert.Error(t, err)
+}
+
+func TestGlobRejectsPatternsOutsideTheRoot(t *testing.T) {
+	for _, pattern := range []string{"..", "../x", "../../**", "src/../../x"} {
+		_, err := Glob(t.TempDir(), []string{pattern})
+		assert.Error(t, err, pattern)
+	}
+}
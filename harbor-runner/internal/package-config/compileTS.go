@@ -22,7 +22,9 @@ func init() {
 	compileOpts["module"] = "commonjs"
 }
 
-func CompileAndExecute(fiName string, resultWriter io.Writer) error {
+// CompileAndExecute runs the TS config fiName and writes the tree it builds to
+// resultWriter. env is added to the environment the config runs in.
+func CompileAndExecute(fiName string, resultWriter io.Writer, env ...string) error {
 	h := sha256.New()
 	h.Write([]byte(fiName))
 	d := fmt.Sprintf("fi-%x", h.Sum(nil))
@@ -49,6 +51,7 @@ func CompileAndExecute(fiName string, resultWriter io.Writer) error {
 	cmd := exec.Command("node", "-e", res)
 	cmd.Dir = path.Dir(fiName)
 	cmd.Env = append(os.Environ(), "HARBORJS_IS_IN_RUNNER=true", fmt.Sprintf("HARBORJS_HARBOR_LOC=%s", fiName))
+	cmd.Env = append(cmd.Env, env...)
 	cmd.Stderr = NewPipedLogger(slog.Error, slog.String("file", fiName))
 	cmd.Stdout = NewPipedLogger(slog.Info, slog.String("file", fiName))
 	err = telemetry.TimeWithError("execute node", cmd.Run)
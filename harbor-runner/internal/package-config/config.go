@@ -8,13 +8,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
 	"path"
 	"path/filepath"
 
 	"github.com/pkg/errors"
 	"github.com/radding/harbor-runner/internal/cache"
+	"github.com/radding/harbor-runner/internal/filelock"
 	"github.com/radding/harbor-runner/internal/telemetry"
+	"github.com/spf13/viper"
 )
 
 type Construct struct {
@@ -37,23 +40,32 @@ type PackageInfo struct {
 	License           string `json:"license"`
 	Stability         string `json:"stability"`
 	ArtifactsLocation string `json:"artifactsLocation"`
+	// Env is the environment every command of the package starts with.
+	Env map[string]string `json:"env"`
 }
 
 type Config struct {
 	hash           string
+	fileName       string
 	cachedLocation string
 	workingDir     string
 	Constructs     map[string]Construct `json:"constructs"`
 	Tasks          map[string]string    `json:"tasks"`
 	Setup          []string             `json:"setup"`
+	Params         map[string]Param     `json:"params"`
+	Resources      map[string]int       `json:"resources"`
 	PackageInfo    PackageInfo          `json:"packageInfo"`
 	WasSetupRun    bool                 `json:"was_setup_run"`
 	cacher         cache.Cache
+	taskCacher     cache.Cache
+	store          *cache.Store
+	paramValues    map[string]string
 }
 
 func NewConfig(cache cache.Cache) *Config {
 	return &Config{
-		cacher: cache,
+		cacher:     cache,
+		taskCacher: cache,
 	}
 }
 
@@ -73,22 +85,81 @@ func ExtractConfigFromContext(ctx context.Context) (*Config, error) {
 	return cfg, nil
 }
 
+// Save writes the config to the cache. Runs in the same package take turns
+// saving, so each save is written out whole.
 func (c *Config) Save() error {
+	if c.store != nil {
+		l, err := filelock.Acquire(filepath.Join(c.store.Base(), "config.lock"))
+		if err != nil {
+			return errors.Wrap(err, "failed to lock configuration")
+		}
+		defer l.Release()
+	}
 	bts, err := json.Marshal(c)
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal configuration")
 	}
-	err = os.WriteFile(c.cachedLocation, bts, 0666)
+	err = c.cacher.Add("config.json", bytes.NewReader(bts))
 	if err != nil {
 		return errors.Wrap(err, "failed to save configuration")
 	}
 	return nil
 }
 
+// GetCache returns the cache for this revision of the config file.
 func (c *Config) GetCache() cache.Cache {
 	return c.cacher
 }
 
+// GetTaskCache returns the cache tasks store their results in. It is shared by
+// every revision of the config file, task entries are keyed by their own
+// inputs so they survive unrelated edits.
+func (c *Config) GetTaskCache() cache.Cache {
+	return c.taskCacher
+}
+
+// GetStore returns the store backing this package's caches, it is nil for
+// configs that were not loaded from disk.
+func (c *Config) GetStore() *cache.Store {
+	return c.store
+}
+
+// ParamValues returns the parameters the config was loaded with, defaults
+// included.
+func (c *Config) ParamValues() map[string]string {
+	return c.paramValues
+}
+
+// WithParams returns the config loaded with the given parameters, they are
+// checked against the parameters the package declares. Defaults are filled
+// in first, so giving a parameter its default value is the same as not
+// giving it at all.
+func (c *Config) WithParams(given map[string]string) (*Config, error) {
+	params, err := ResolveParams(c.Params, given)
+	if err != nil {
+		return nil, err
+	}
+	if maps.Equal(params, c.paramValues) {
+		return c, nil
+	}
+	config, err := loadConfig(c.fileName, params)
+	if err != nil {
+		return nil, err
+	}
+	config.WasSetupRun = config.WasSetupRun || c.WasSetupRun
+	return &config, nil
+}
+
+// FileName returns the .harborrc.ts this config was loaded from.
+func (c *Config) FileName() string {
+	return c.fileName
+}
+
+// WorkingDir returns the root of the package, where its .harborrc.ts lives.
+func (c *Config) WorkingDir() string {
+	return c.workingDir
+}
+
 type WorkingDirCacheKeyType string
 
 var WorkingDirCacheKey = WorkingDirCacheKeyType("WorkingDir")
@@ -100,11 +171,29 @@ func (c *Config) ConfigureContext(ct context.Context) context.Context {
 	return ctx
 }
 
+// CacheOptions are the options caches are opened with, from the harbor
+// config file.
+func CacheOptions() []cache.Option {
+	return []cache.Option{
+		cache.WithCompression(viper.GetString("cache_compression"), viper.GetInt("cache_compression_level")),
+	}
+}
+
 var configs map[string]Config = map[string]Config{}
 
 func LoadConfig(fileName string) (Config, error) {
+	return loadConfig(fileName, nil)
+}
+
+// loadConfig loads the config of fileName as the TS config builds it with the
+// given parameters. Each set of parameters is cached on its own.
+func loadConfig(fileName string, params map[string]string) (Config, error) {
 	telemetry.Trace(fmt.Sprintf("loading %s config", fileName))
-	if conf, ok := configs[fileName]; ok {
+	memoKey := fileName
+	if hash := paramsHash(params); hash != "" {
+		memoKey = fmt.Sprintf("%s#%s", fileName, hash)
+	}
+	if conf, ok := configs[memoKey]; ok {
 		slog.Debug("config already loaded into memory, returning it now", slog.String("file", fileName))
 		return conf, nil
 	}
@@ -115,17 +204,33 @@ func LoadConfig(fileName string) (Config, error) {
 	}
 	info, _ := filepath.Abs(fileName)
 	hasher.Write(s)
+	if hash := paramsHash(params); hash != "" {
+		fmt.Fprintf(hasher, "\nparams:%s", hash)
+	}
 	hashedFile := hex.EncodeToString(hasher.Sum(nil))
 	configPath := path.Join(path.Dir(info), "./.harbor", hashedFile, "config.json")
 	var config = Config{
 		WasSetupRun:    false,
+		fileName:       fileName,
 		cachedLocation: configPath,
 		workingDir:     path.Dir(fileName),
 	}
-	config.cacher, err = cache.New(path.Dir(configPath))
+	config.store, err = cache.Open(path.Join(path.Dir(info), "./.harbor"), CacheOptions()...)
 	if err != nil {
 		return config, errors.Wrap(err, "failed to create cache")
 	}
+	config.cacher, err = config.store.Root().GetSubCache(hashedFile)
+	if err != nil {
+		return config, errors.Wrap(err, "failed to create config cache")
+	}
+	config.taskCacher, err = config.store.Root().GetSubCache("tasks")
+	if err != nil {
+		return config, errors.Wrap(err, "failed to create task cache")
+	}
+	if remoteURL := viper.GetString("remote_cache_url"); remoteURL != "" {
+		slog.Debug("using remote cache", slog.String("url", remoteURL))
+		config.taskCacher = cache.NewRemote(remoteURL, config.taskCacher, cache.WithReadOnly(viper.GetBool("remote_cache_read_only")))
+	}
 	slog.Debug(fmt.Sprintf("loading config from %s", configPath))
 	buff := new(bytes.Buffer)
 	success, err := config.cacher.Get("config.json", buff)
@@ -134,7 +239,7 @@ func LoadConfig(fileName string) (Config, error) {
 	}
 	makeConfigFunc := func() error {
 		buffer := new(bytes.Buffer)
-		err := CompileAndExecute(info, buffer)
+		err := CompileAndExecute(info, buffer, ParamsEnv(params)...)
 		if err != nil {
 			return errors.Wrap(err, "failed to execute config file")
 		}
@@ -152,7 +257,18 @@ func LoadConfig(fileName string) (Config, error) {
 		return nil
 	}
 	config.hash = hashedFile
-	configs[fileName] = config
+	configs[memoKey] = config
+	// Corrupted entries are already misses, a cached config that no longer
+	// parses is quarantined like any other unusable entry and rebuilt.
+	if success {
+		if err = json.Unmarshal(buff.Bytes(), &config); err != nil {
+			slog.Warn("looks like a bad config was cached, attempting to recover", slog.String("error", err.Error()))
+			if err := cache.Quarantine(config.cacher, "config.json", err.Error()); err != nil {
+				slog.Warn("failed to quarantine the cached config", slog.String("error", err.Error()))
+			}
+			success = false
+		}
+	}
 	if !success {
 		slog.Debug("config isn't cached, creating it now", slog.String("CachedPath", configPath))
 		err := telemetry.TimeWithError("compile config", makeConfigFunc)
@@ -160,15 +276,10 @@ func LoadConfig(fileName string) (Config, error) {
 			slog.Error("Faild to execute configuration file", slog.String("error", err.Error()))
 			return config, nil
 		}
-	} else {
-		if err = json.Unmarshal(buff.Bytes(), &config); err != nil {
-			slog.Warn("looks like a bad config was cached, attempting to recover", slog.String("error", err.Error()))
-			err := makeConfigFunc()
-			if err != nil {
-				slog.Warn("Cache Recovery failed, harbor may act weird because of this", slog.String("error", err.Error()))
-				return config, nil
-			}
-		}
+	}
+	config.paramValues, err = ResolveParams(config.Params, params)
+	if err != nil {
+		return config, errors.Wrap(err, "failed to resolve parameters")
 	}
 
 	return config, nil
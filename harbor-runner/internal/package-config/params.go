@@ -0,0 +1,138 @@
+package packageconfig
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParamsEnvVar holds the parameters of a run as a JSON object of strings, it
+// is set for the TS config and for the commands tasks run.
+const ParamsEnvVar = "HARBOR_PARAMS"
+
+// Param is a parameter declared by the package with `pkg.param`.
+type Param struct {
+	// Type is one of string, number or boolean.
+	Type        string          `json:"type"`
+	Description string          `json:"description,omitempty"`
+	Default     json.RawMessage `json:"default,omitempty"`
+	Choices     []string        `json:"choices,omitempty"`
+}
+
+// parse checks value is of the parameter's type and normalizes it, so equal
+// values are passed on, and hashed, the same way.
+func (p Param) parse(value string) (string, error) {
+	switch p.Type {
+	case "number":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", fmt.Errorf("expected a number, got %q", value)
+		}
+		value = strconv.FormatFloat(n, 'f', -1, 64)
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("expected true or false, got %q", value)
+		}
+		value = strconv.FormatBool(b)
+	case "string", "":
+	default:
+		return "", fmt.Errorf("unknown parameter type %s", p.Type)
+	}
+	if len(p.Choices) > 0 && !slices.Contains(p.Choices, value) {
+		return "", fmt.Errorf("expected one of %s, got %q", strings.Join(p.Choices, ", "), value)
+	}
+	return value, nil
+}
+
+// defaultValue returns the parameter's default as it would be given on the
+// command line, false when it has none.
+func (p Param) defaultValue() (string, bool) {
+	if len(p.Default) == 0 || string(p.Default) == "null" {
+		return "", false
+	}
+	var text string
+	if err := json.Unmarshal(p.Default, &text); err == nil {
+		return text, true
+	}
+	return string(p.Default), true
+}
+
+// ResolveParams checks the given parameters against the declared ones and
+// fills in the defaults of those that were not given.
+func ResolveParams(declared map[string]Param, given map[string]string) (map[string]string, error) {
+	values := map[string]string{}
+	names := make([]string, 0, len(given))
+	for name := range given {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := given[name]
+		param, ok := declared[name]
+		if !ok {
+			if len(declared) == 0 {
+				return nil, fmt.Errorf("unknown parameter %s, the package declares no parameters", name)
+			}
+			return nil, fmt.Errorf("unknown parameter %s, declared parameters are %s", name, strings.Join(paramNames(declared), ", "))
+		}
+		parsed, err := param.parse(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid parameter %s", name)
+		}
+		values[name] = parsed
+	}
+	for name, param := range declared {
+		if _, ok := values[name]; ok {
+			continue
+		}
+		value, ok := param.defaultValue()
+		if !ok {
+			continue
+		}
+		parsed, err := param.parse(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid default of parameter %s", name)
+		}
+		values[name] = parsed
+	}
+	return values, nil
+}
+
+func paramNames(declared map[string]Param) []string {
+	names := make([]string, 0, len(declared))
+	for name := range declared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParamsEnv returns the environment variable passing params on, empty when
+// there are none.
+func ParamsEnv(params map[string]string) []string {
+	if len(params) == 0 {
+		return nil
+	}
+	bts, _ := json.Marshal(params)
+	return []string{fmt.Sprintf("%s=%s", ParamsEnvVar, bts)}
+}
+
+// paramsHash identifies a set of parameters, empty when there are none so
+// configs loaded without parameters keep their cache location.
+func paramsHash(params map[string]string) string {
+	if len(params) == 0 {
+		return ""
+	}
+	// json.Marshal sorts the keys
+	bts, _ := json.Marshal(params)
+	h := sha256.Sum256(bts)
+	return hex.EncodeToString(h[:])
+}
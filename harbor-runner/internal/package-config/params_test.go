@@ -0,0 +1,51 @@
+package packageconfig
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveParamsChecksTypesAndFillsDefaults(t *testing.T) {
+	assert := assert.New(t)
+	declared := map[string]Param{
+		"env":     {Type: "string", Default: json.RawMessage(`"dev"`), Choices: []string{"dev", "staging"}},
+		"shards":  {Type: "number", Default: json.RawMessage(`4`)},
+		"verbose": {Type: "boolean"},
+	}
+
+	values, err := ResolveParams(declared, map[string]string{"env": "staging", "shards": "2.0", "verbose": "1"})
+	assert.NoError(err)
+	assert.Equal(map[string]string{"env": "staging", "shards": "2", "verbose": "true"}, values)
+
+	values, err = ResolveParams(declared, nil)
+	assert.NoError(err)
+	assert.Equal(map[string]string{"env": "dev", "shards": "4"}, values)
+
+	_, err = ResolveParams(declared, map[string]string{"env": "prod"})
+	assert.ErrorContains(err, "invalid parameter env: expected one of dev, staging")
+	_, err = ResolveParams(declared, map[string]string{"shards": "many"})
+	assert.ErrorContains(err, "expected a number")
+	_, err = ResolveParams(declared, map[string]string{"region": "eu"})
+	assert.ErrorContains(err, "unknown parameter region, declared parameters are env, shards, verbose")
+}
+
+func TestGivingDefaultParamsKeepsTheConfig(t *testing.T) {
+	assert := assert.New(t)
+	declared := map[string]Param{
+		"env":    {Type: "string", Default: json.RawMessage(`"dev"`)},
+		"shards": {Type: "number", Default: json.RawMessage(`4`)},
+	}
+	defaults, err := ResolveParams(declared, nil)
+	assert.NoError(err)
+	cfg := &Config{Params: declared, paramValues: defaults}
+
+	for _, given := range []map[string]string{nil, {"env": "dev"}, {"env": "dev", "shards": "4.0"}} {
+		same, err := cfg.WithParams(given)
+		assert.NoError(err)
+		assert.Same(cfg, same)
+	}
+	_, err = cfg.WithParams(map[string]string{"region": "eu"})
+	assert.ErrorContains(err, "unknown parameter region")
+}
@@ -0,0 +1,57 @@
+package taskgraph
+
+import (
+	"context"
+)
+
+type argsContextKeyType string
+
+const _ARGS_CONTEXT_KEY = argsContextKeyType("ARGS")
+
+// passthrough holds the extra arguments of a run. They go to the tasks the run
+// was asked for, its entries, and not to the tasks those need.
+type passthrough struct {
+	args    []string
+	entries map[*Task]bool
+}
+
+// WithArgs passes args on to the tasks the next run starts from, like the
+// arguments after `--` of `harbor run`.
+func WithArgs(ctx context.Context, args []string) context.Context {
+	if len(args) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, _ARGS_CONTEXT_KEY, &passthrough{args: args})
+}
+
+// bindArgs makes roots the entries of the run, unless an enclosing run
+// already picked its own.
+func bindArgs(ctx context.Context, roots []*Task) context.Context {
+	p, ok := ctx.Value(_ARGS_CONTEXT_KEY).(*passthrough)
+	if !ok || p.entries != nil {
+		return ctx
+	}
+	entries := map[*Task]bool{}
+	for _, root := range roots {
+		entries[root] = true
+	}
+	return context.WithValue(ctx, _ARGS_CONTEXT_KEY, &passthrough{args: p.args, entries: entries})
+}
+
+func argsFor(ctx context.Context, t *Task) []string {
+	p, ok := ctx.Value(_ARGS_CONTEXT_KEY).(*passthrough)
+	if !ok || !p.entries[t] {
+		return nil
+	}
+	return p.args
+}
+
+// GetArgsFromContext returns the extra arguments of the task being executed,
+// nil unless it is one the run was asked for.
+func GetArgsFromContext(ctx context.Context) []string {
+	t, ok := ctx.Value(_TASK_CONTEXT_KEY).(*Task)
+	if !ok {
+		return nil
+	}
+	return argsFor(ctx, t)
+}
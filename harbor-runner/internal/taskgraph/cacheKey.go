@@ -0,0 +1,263 @@
+package taskgraph
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/radding/harbor-runner/internal/fileset"
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+)
+
+// keyVersion is mixed into every cache key, bump it when the way keys are
+// computed changes so old entries stop being replayed.
+const keyVersion = "1"
+
+// Fingerprinter can be implemented by an Executor to contribute state that
+// lives outside of a construct's options to its cache key, such as the task
+// graph of a local dependency.
+type Fingerprinter interface {
+	Fingerprint(ctx context.Context, kind string, opts json.RawMessage) (string, error)
+}
+
+// taskOptions are the options every construct may declare regardless of its
+// kind. They are interpreted by the task graph rather than by the executor.
+type taskOptions struct {
+	Inputs  []string `json:"inputs"`
+	Timeout duration `json:"timeout"`
+	Retries int      `json:"retries"`
+	Backoff backoff  `json:"backoff"`
+	// AllowFailure lets the tasks that need this one run even when it fails.
+	AllowFailure bool `json:"allowFailure"`
+	// Locks are the resources the task holds while it runs.
+	Locks []lock `json:"locks"`
+	// Priority makes the task start before ready tasks of a lower priority.
+	Priority int `json:"priority"`
+}
+
+func (t *Task) parseOptions() (taskOptions, error) {
+	opts := taskOptions{}
+	if len(t.Options) == 0 {
+		return opts, nil
+	}
+	if err := json.Unmarshal(t.Options, &opts); err != nil {
+		return opts, errors.Wrapf(err, "failed to parse options of %s", t.ID)
+	}
+	if err := opts.validate(); err != nil {
+		return opts, errors.Wrapf(err, "invalid options for %s", t.ID)
+	}
+	return opts, nil
+}
+
+// KeyInputs describes everything that went into a task's cache key, it is
+// kept next to cache entries to explain why a task did or did not replay.
+// Params are the parameters of the run and Args the extra arguments the task
+// was given, if it is one the run was asked for.
+type KeyInputs struct {
+	Kind         string            `json:"kind"`
+	Platform     string            `json:"platform"`
+	Options      json.RawMessage   `json:"options"`
+	Params       map[string]string `json:"params,omitempty"`
+	Args         []string          `json:"args,omitempty"`
+	Inputs       map[string]string `json:"inputs"`
+	Fingerprint  string            `json:"fingerprint,omitempty"`
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// digest hashes the inputs into the cache key.
+func (k *KeyInputs) digest() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "version:%s\n", keyVersion)
+	fmt.Fprintf(h, "kind:%s\n", k.Kind)
+	fmt.Fprintf(h, "platform:%s\n", k.Platform)
+	fmt.Fprintf(h, "options:%s\n", k.Options)
+	for _, name := range sortedKeys(k.Params) {
+		fmt.Fprintf(h, "param:%s:%s\n", name, k.Params[name])
+	}
+	if len(k.Args) > 0 {
+		args, _ := json.Marshal(k.Args)
+		fmt.Fprintf(h, "args:%s\n", args)
+	}
+	for _, file := range sortedKeys(k.Inputs) {
+		fmt.Fprintf(h, "input:%s:%s\n", file, k.Inputs[file])
+	}
+	if k.Fingerprint != "" {
+		fmt.Fprintf(h, "fingerprint:%s\n", k.Fingerprint)
+	}
+	for _, dep := range sortedKeys(k.Dependencies) {
+		fmt.Fprintf(h, "dependency:%s:%s\n", dep, k.Dependencies[dep])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type keyerContextKeyType string
+
+const _KEYER_CONTEXT_KEY = keyerContextKeyType("KEYER")
+
+type keyEntry struct {
+	key    string
+	inputs *KeyInputs
+}
+
+// keyer memoizes the cache keys computed during a run so shared dependencies
+// are only hashed once.
+type keyer struct {
+	mu   sync.Mutex
+	keys map[*Task]keyEntry
+}
+
+func newKeyer() *keyer {
+	return &keyer{
+		keys: map[*Task]keyEntry{},
+	}
+}
+
+func withKeyer(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(_KEYER_CONTEXT_KEY).(*keyer); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, _KEYER_CONTEXT_KEY, newKeyer())
+}
+
+func keyerFromContext(ctx context.Context) *keyer {
+	k, ok := ctx.Value(_KEYER_CONTEXT_KEY).(*keyer)
+	if !ok {
+		return newKeyer()
+	}
+	return k
+}
+
+// CacheKey returns the digest identifying this task's cached results. It
+// covers the task's kind, options, parameters and arguments, platform, the
+// contents of its declared inputs and the keys of all of its dependencies, so
+// any change to those produces a new key.
+func (t *Task) CacheKey(ctx context.Context) (string, error) {
+	entry, err := keyerFromContext(ctx).key(ctx, t)
+	return entry.key, err
+}
+
+// CacheKeyInputs returns what went into the task's cache key.
+func (t *Task) CacheKeyInputs(ctx context.Context) (*KeyInputs, error) {
+	entry, err := keyerFromContext(ctx).key(ctx, t)
+	return entry.inputs, err
+}
+
+func (k *keyer) key(ctx context.Context, t *Task) (keyEntry, error) {
+	k.mu.Lock()
+	entry, ok := k.keys[t]
+	k.mu.Unlock()
+	if ok {
+		return entry, nil
+	}
+
+	workingDir, ok := ctx.Value(packageconfig.WorkingDirCacheKey).(string)
+	if !ok {
+		return entry, errors.New("working location not in context")
+	}
+	opts, err := t.parseOptions()
+	if err != nil {
+		return entry, err
+	}
+	options, err := canonicalJSON(t.Options)
+	if err != nil {
+		return entry, errors.Wrapf(err, "failed to normalize options of %s", t.ID)
+	}
+	inputs := &KeyInputs{
+		Kind:         t.Kind,
+		Platform:     fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
+		Options:      options,
+		Args:         argsFor(ctx, t),
+		Inputs:       map[string]string{},
+		Dependencies: map[string]string{},
+	}
+
+	if cfg, err := packageconfig.ExtractConfigFromContext(ctx); err == nil {
+		inputs.Params = cfg.ParamValues()
+	}
+
+	files, err := fileset.Glob(workingDir, opts.Inputs)
+	if err != nil {
+		return entry, errors.Wrapf(err, "failed to resolve inputs of %s", t.ID)
+	}
+	for _, file := range files {
+		sum, err := hashFile(filepath.Join(workingDir, filepath.FromSlash(file)))
+		if err != nil {
+			return entry, errors.Wrapf(err, "failed to hash input %s of %s", file, t.ID)
+		}
+		inputs.Inputs[file] = sum
+	}
+
+	if fp, ok := t.executor.(Fingerprinter); ok {
+		inputs.Fingerprint, err = fp.Fingerprint(context.WithValue(ctx, _TASK_CONTEXT_KEY, t), t.Kind, t.Options)
+		if err != nil {
+			return entry, errors.Wrapf(err, "failed to fingerprint %s", t.ID)
+		}
+	}
+
+	for _, dep := range t.Dependencies {
+		depEntry, err := k.key(ctx, dep)
+		if err != nil {
+			return entry, err
+		}
+		inputs.Dependencies[dep.ID] = depEntry.key
+	}
+
+	entry = keyEntry{
+		key:    inputs.digest(),
+		inputs: inputs,
+	}
+	k.mu.Lock()
+	k.keys[t] = entry
+	k.mu.Unlock()
+	return entry, nil
+}
+
+// canonicalJSON re-encodes raw so semantically equal options hash the same
+// regardless of key order or whitespace. Policy options are dropped, they
+// don't change what a task produces.
+func canonicalJSON(raw json.RawMessage) ([]byte, error) {
+	if len(raw) == 0 {
+		return []byte("null"), nil
+	}
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	if opts, ok := v.(map[string]any); ok {
+		for _, option := range policyOptions {
+			delete(opts, option)
+		}
+	}
+	return json.Marshal(v)
+}
+
+func hashFile(fileName string) (string, error) {
+	fi, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer fi.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fi); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
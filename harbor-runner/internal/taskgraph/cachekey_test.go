@@ -0,0 +1,97 @@
+package taskgraph
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+	"github.com/stretchr/testify/assert"
+)
+
+func keyContext(dir string) context.Context {
+	ctx := cfg.ConfigureContext(context.Background())
+	return context.WithValue(ctx, packageconfig.WorkingDirCacheKey, dir)
+}
+
+func TestCacheKeyTracksInputs(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "src", "nested"), 0755))
+	assert.NoError(os.WriteFile(filepath.Join(dir, "src", "nested", "main.go"), []byte("package main"), 0644))
+	assert.NoError(os.WriteFile(filepath.Join(dir, "README.md"), []byte("docs"), 0644))
+
+	task := &Task{
+		ID:       "pkg/build",
+		Kind:     "harbor.dev/ExecCommand",
+		Options:  json.RawMessage(`{"executable": "go", "inputs": ["src/**/*.go"]}`),
+		executor: &MockExecutor{},
+	}
+
+	first, err := task.CacheKey(keyContext(dir))
+	assert.NoError(err)
+	again, err := task.CacheKey(keyContext(dir))
+	assert.NoError(err)
+	assert.Equal(first, again)
+
+	assert.NoError(os.WriteFile(filepath.Join(dir, "README.md"), []byte("more docs"), 0644))
+	unrelated, err := task.CacheKey(keyContext(dir))
+	assert.NoError(err)
+	assert.Equal(first, unrelated)
+
+	assert.NoError(os.WriteFile(filepath.Join(dir, "src", "nested", "main.go"), []byte("package main\n"), 0644))
+	changed, err := task.CacheKey(keyContext(dir))
+	assert.NoError(err)
+	assert.NotEqual(first, changed)
+}
+
+func TestCacheKeyIncludesDependencies(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(dir, "input.txt"), []byte("one"), 0644))
+
+	dep := &Task{
+		ID:       "pkg/dep",
+		Kind:     "harbor.dev/ExecCommand",
+		Options:  json.RawMessage(`{"inputs": ["input.txt"]}`),
+		executor: &MockExecutor{},
+	}
+	root := &Task{
+		ID:           "pkg/root",
+		Kind:         "harbor.dev/ExecCommand",
+		Options:      json.RawMessage(`{"executable": "true"}`),
+		Dependencies: []*Task{dep},
+		executor:     &MockExecutor{},
+	}
+
+	first, err := root.CacheKey(keyContext(dir))
+	assert.NoError(err)
+	assert.NoError(os.WriteFile(filepath.Join(dir, "input.txt"), []byte("two"), 0644))
+	second, err := root.CacheKey(keyContext(dir))
+	assert.NoError(err)
+	assert.NotEqual(first, second)
+}
+
+func TestCacheKeyIgnoresOptionOrder(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	a := &Task{
+		ID:       "pkg/a",
+		Kind:     "harbor.dev/ExecCommand",
+		Options:  json.RawMessage(`{"executable": "go", "args": ["test"]}`),
+		executor: &MockExecutor{},
+	}
+	b := &Task{
+		ID:       "pkg/a",
+		Kind:     "harbor.dev/ExecCommand",
+		Options:  json.RawMessage(`{ "args": ["test"],  "executable": "go" }`),
+		executor: &MockExecutor{},
+	}
+	keyA, err := a.CacheKey(keyContext(dir))
+	assert.NoError(err)
+	keyB, err := b.CacheKey(keyContext(dir))
+	assert.NoError(err)
+	assert.Equal(keyA, keyB)
+}
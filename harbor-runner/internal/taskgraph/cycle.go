@@ -0,0 +1,137 @@
+package taskgraph
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+)
+
+// CycleNode is a construct taking part in a dependency cycle.
+type CycleNode struct {
+	ID   string
+	Kind string
+	// ConfigFile is the .harborrc.ts that declares the construct.
+	ConfigFile string
+	// Detail describes what the construct points at, like the task of a local
+	// dependency it runs.
+	Detail string
+}
+
+func (c CycleNode) String() string {
+	where := c.ConfigFile
+	if where == "" {
+		where = "the package config"
+	}
+	desc := fmt.Sprintf("%s (%s in %s", c.ID, c.Kind, where)
+	if c.Detail != "" {
+		desc += ", " + c.Detail
+	}
+	return desc + ")"
+}
+
+// CycleError is returned when constructs depend on each other in a cycle. The
+// first and last nodes of Path are the same construct.
+type CycleError struct {
+	Path []CycleNode
+}
+
+func (c *CycleError) Error() string {
+	ids := make([]string, len(c.Path))
+	for i, node := range c.Path {
+		ids[i] = node.ID
+	}
+	buf := &strings.Builder{}
+	fmt.Fprintf(buf, "dependency cycle detected: %s\n", strings.Join(ids, " -> "))
+	for i, node := range c.Path[:len(c.Path)-1] {
+		fmt.Fprintf(buf, "  %d. %s\n", i+1, node)
+	}
+	from, to := c.Path[len(c.Path)-2], c.Path[len(c.Path)-1]
+	fmt.Fprintf(buf, "the cycle was closed by %s depending on %s, %s", from.ID, to.ID, likelyCall(from, to))
+	return buf.String()
+}
+
+// likelyCall guesses which call in a .harborrc.ts made from depend on to.
+func likelyCall(from, to CycleNode) string {
+	switch from.Kind {
+	case "harbor.dev/noop":
+		return fmt.Sprintf("look for a Pipeline listing %s after %s", from.ID, to.ID)
+	case "harbor.dev/PackageSetup":
+		return fmt.Sprintf("look for %s in the actions of the PackageSetup %s", to.ID, from.ID)
+	}
+	if from.ConfigFile != to.ConfigFile {
+		return fmt.Sprintf("look for a needs() or then() call on %s in %s", from.ID, from.ConfigFile)
+	}
+	return fmt.Sprintf("likely from %s.needs(%s) or %s.then(%s)", from.ID, to.ID, to.ID, from.ID)
+}
+
+type remoteTaskOptions struct {
+	Dependency struct {
+		Path string `json:"path"`
+		URL  string `json:"url"`
+	} `json:"dependency"`
+	Run string `json:"run"`
+}
+
+func newCycleNode(cfg *packageconfig.Config, id string) CycleNode {
+	construct := cfg.Constructs[id]
+	node := CycleNode{
+		ID:         id,
+		Kind:       construct.Kind,
+		ConfigFile: cfg.FileName(),
+	}
+	if construct.Kind == "harbor.dev/RemoteTask" {
+		opts := remoteTaskOptions{}
+		if err := json.Unmarshal(construct.Options, &opts); err == nil {
+			dep := opts.Dependency.Path
+			if dep == "" {
+				dep = opts.Dependency.URL
+			}
+			node.Detail = fmt.Sprintf("runs task %s of dependency %s", opts.Run, dep)
+		}
+	}
+	return node
+}
+
+func newCycleError(cfg *packageconfig.Config, path []string) *CycleError {
+	nodes := make([]CycleNode, len(path))
+	for i, id := range path {
+		nodes[i] = newCycleNode(cfg, id)
+	}
+	return &CycleError{
+		Path: nodes,
+	}
+}
+
+const _DEPENDENCY_CHAIN_CONTEXT_KEY = taskContextKeyType("DEPENDENCY_CHAIN")
+
+// EnterDependencyTask records that the construct fromID, of the package
+// configured in ctx, runs taskName of the local dependency dep. Packages are
+// built into separate trees, so a cycle between them can only be found while
+// following these calls: it fails with a CycleError when taskName leads back
+// to a construct that is already on the way.
+func EnterDependencyTask(ctx context.Context, fromID string, dep *packageconfig.Config, taskName string) (context.Context, error) {
+	from, err := packageconfig.ExtractConfigFromContext(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	chain, _ := ctx.Value(_DEPENDENCY_CHAIN_CONTEXT_KEY).([]CycleNode)
+	nodes := []CycleNode{newCycleNode(from, fromID)}
+	if id, ok := dep.Tasks[taskName]; ok {
+		nodes = append(nodes, newCycleNode(dep, id))
+	}
+	for _, node := range nodes {
+		for ndx, seen := range chain {
+			if seen.ID == node.ID && seen.ConfigFile == node.ConfigFile {
+				return ctx, &CycleError{
+					Path: append(slices.Clone(chain[ndx:]), node),
+				}
+			}
+		}
+		chain = append(slices.Clone(chain), node)
+	}
+	return context.WithValue(ctx, _DEPENDENCY_CHAIN_CONTEXT_KEY, chain), nil
+}
@@ -0,0 +1,79 @@
+package taskgraph
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/radding/harbor-runner/internal/cache"
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+	"github.com/stretchr/testify/assert"
+)
+
+func cyclicConfig() *packageconfig.Config {
+	c := packageconfig.NewConfig(&cache.NonCache{})
+	c.Constructs = map[string]packageconfig.Construct{
+		"pkg/build":  {Kind: "harbor.dev/ExecCommand", DependsOn: []string{"pkg/test"}},
+		"pkg/test":   {Kind: "harbor.dev/ExecCommand", DependsOn: []string{"pkg/lint"}},
+		"pkg/lint":   {Kind: "harbor.dev/ExecCommand", DependsOn: []string{"pkg/test"}},
+		"pkg/setup":  {Kind: "harbor.dev/PackageSetup", DependsOn: []string{"pkg/setup"}},
+		"pkg/deploy": {Kind: "harbor.dev/ExecCommand", DependsOn: []string{"pkg/build"}},
+	}
+	c.Tasks = map[string]string{
+		"deploy": "pkg/deploy",
+	}
+	return c
+}
+
+func TestCreateTreeDetectsCycles(t *testing.T) {
+	assert := assert.New(t)
+	_, err := CreateTreeFromConfig(cyclicConfig(), &MockExecutor{})
+	assert.Error(err)
+	var cycle *CycleError
+	assert.True(errors.As(err, &cycle))
+	ids := []string{}
+	for _, node := range cycle.Path {
+		ids = append(ids, node.ID)
+	}
+	assert.Equal([]string{"pkg/test", "pkg/lint", "pkg/test"}, ids)
+	assert.Contains(err.Error(), "pkg/test -> pkg/lint -> pkg/test")
+	assert.Contains(err.Error(), "pkg/lint.needs(pkg/test) or pkg/test.then(pkg/lint)")
+}
+
+func TestCreateTreeDetectsSelfCycles(t *testing.T) {
+	assert := assert.New(t)
+	c := cyclicConfig()
+	c.Tasks = map[string]string{}
+	c.Setup = []string{"pkg/setup"}
+	_, err := CreateTreeFromConfig(c, &MockExecutor{})
+	var cycle *CycleError
+	assert.True(errors.As(err, &cycle))
+	assert.Len(cycle.Path, 2)
+	assert.Contains(err.Error(), "actions of the PackageSetup pkg/setup")
+}
+
+func TestEnterDependencyTaskDetectsCyclesBetweenPackages(t *testing.T) {
+	assert := assert.New(t)
+	a := packageconfig.NewConfig(&cache.NonCache{})
+	a.Constructs = map[string]packageconfig.Construct{
+		"a/build":     {Kind: "harbor.dev/ExecCommand"},
+		"a/dep-build": {Kind: "harbor.dev/RemoteTask"},
+	}
+	a.Tasks = map[string]string{"build": "a/build"}
+	b := packageconfig.NewConfig(&cache.NonCache{})
+	b.Constructs = map[string]packageconfig.Construct{
+		"b/build":     {Kind: "harbor.dev/ExecCommand"},
+		"b/dep-build": {Kind: "harbor.dev/RemoteTask"},
+	}
+	b.Tasks = map[string]string{"build": "b/build"}
+
+	ctx, err := EnterDependencyTask(a.ConfigureContext(context.Background()), "a/dep-build", b, "build")
+	assert.NoError(err)
+	ctx, err = EnterDependencyTask(b.ConfigureContext(ctx), "b/dep-build", a, "build")
+	assert.NoError(err)
+	_, err = EnterDependencyTask(a.ConfigureContext(ctx), "a/dep-build", b, "build")
+	var cycle *CycleError
+	assert.True(errors.As(err, &cycle))
+	assert.Equal("a/dep-build", cycle.Path[0].ID)
+	assert.Equal("a/dep-build", cycle.Path[len(cycle.Path)-1].ID)
+}
@@ -3,6 +3,7 @@ package taskgraph
 import (
 	"context"
 	"fmt"
+	"slices"
 
 	"github.com/pkg/errors"
 	packageconfig "github.com/radding/harbor-runner/internal/package-config"
@@ -17,11 +18,64 @@ func (e *ExecutionTree) RunSetup(ctx context.Context) error {
 	return e.setupTask.Execute(ctx)
 }
 func (e *ExecutionTree) RunTask(ctx context.Context, taskName string) error {
-	task, ok := e.tasks[taskName]
-	if !ok {
-		return fmt.Errorf("can not find task with name %s", taskName)
+	return e.RunTasks(ctx, taskName)
+}
+
+// RunTasks runs the tasks registered as taskNames as a single graph, tasks
+// they have in common run once and the rest in parallel.
+func (e *ExecutionTree) RunTasks(ctx context.Context, taskNames ...string) error {
+	tasks, err := e.LookupTasks(taskNames...)
+	if err != nil {
+		return err
+	}
+	return executeGraph(ctx, tasks...)
+}
+
+// LookupTasks returns the tasks registered as taskNames. Names that are not
+// registered are reported together in an *UnknownTasksError.
+func (e *ExecutionTree) LookupTasks(taskNames ...string) ([]*Task, error) {
+	tasks := []*Task{}
+	unknown := &UnknownTasksError{
+		Suggestions: map[string][]string{},
+	}
+	for _, name := range taskNames {
+		task, ok := e.tasks[name]
+		if !ok {
+			unknown.Names = append(unknown.Names, name)
+			continue
+		}
+		if !slices.Contains(tasks, task) {
+			tasks = append(tasks, task)
+		}
 	}
-	return task.Execute(ctx)
+	if len(unknown.Names) == 0 {
+		return tasks, nil
+	}
+	unknown.Registered = e.TaskNames()
+	for _, name := range unknown.Names {
+		unknown.Suggestions[name] = suggest(name, unknown.Registered)
+	}
+	return nil, unknown
+}
+
+// TaskNames returns the names of the registered tasks, sorted.
+func (e *ExecutionTree) TaskNames() []string {
+	names := make([]string, 0, len(e.tasks))
+	for name := range e.tasks {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// TaskKey returns the cache key the task registered as taskName would run
+// with, without running it.
+func (e *ExecutionTree) TaskKey(ctx context.Context, taskName string) (string, error) {
+	tasks, err := e.LookupTasks(taskName)
+	if err != nil {
+		return "", err
+	}
+	return tasks[0].CacheKey(ctx)
 }
 
 func CreateTreeFromConfig(cfg *packageconfig.Config, executor Executor) (*ExecutionTree, error) {
@@ -37,12 +91,18 @@ func CreateTreeFromConfig(cfg *packageconfig.Config, executor Executor) (*Execut
 		tasks:     map[string]*Task{},
 	}
 	constructs := map[string]*Task{}
+	// visiting holds the constructs whose dependencies are being created, in
+	// order, running into one of them again means there is a cycle.
+	visiting := []string{}
 
 	var createTask func(taskID string) (*Task, error)
 	createTask = func(taskID string) (*Task, error) {
 		if elem, ok := constructs[taskID]; ok {
 			return elem, nil
 		}
+		if ndx := slices.Index(visiting, taskID); ndx >= 0 {
+			return nil, newCycleError(cfg, append(slices.Clone(visiting[ndx:]), taskID))
+		}
 		taskDef, ok := cfg.Constructs[taskID]
 		if !ok {
 			return nil, fmt.Errorf("failed to find construct of id %s", taskID)
@@ -53,17 +113,19 @@ func CreateTreeFromConfig(cfg *packageconfig.Config, executor Executor) (*Execut
 			Kind:          taskDef.Kind,
 			Options:       taskDef.Options,
 			Dependencies:  []*Task{},
-			done:          false,
-			err:           nil,
 			dependencySet: map[string]bool{},
 		}
+		visiting = append(visiting, taskID)
 		for _, childID := range taskDef.DependsOn {
 			childTask, err := createTask(childID)
-			if err != nil {
+			if _, ok := err.(*CycleError); ok {
+				return nil, err
+			} else if err != nil {
 				return nil, errors.Wrapf(err, "failed to create child of %s", taskID)
 			}
 			t.addDependency(childTask)
 		}
+		visiting = visiting[:len(visiting)-1]
 		constructs[taskID] = t
 		return t, nil
 	}
@@ -1,7 +1,9 @@
 package taskgraph
 
 import (
+	"context"
 	"encoding/json"
+	"sync"
 	"testing"
 
 	"github.com/radding/harbor-runner/internal/cache"
@@ -193,3 +195,72 @@ var testConfig = `{
     },
     "was_setup_run": true
 }`
+
+func TestLookupTasksSuggestsRegisteredNames(t *testing.T) {
+	assert := assert.New(t)
+	tree, err := CreateTreeFromConfig(cfg, &MockExecutor{})
+	assert.NoError(err)
+
+	tasks, err := tree.LookupTasks("lint", "test", "lint")
+	assert.NoError(err)
+	assert.Len(tasks, 2)
+
+	_, err = tree.LookupTasks("lnt", "build", "tset", "deploy")
+	unknown, ok := err.(*UnknownTasksError)
+	assert.True(ok)
+	assert.Equal([]string{"lnt", "tset", "deploy"}, unknown.Names)
+	assert.Equal([]string{"lint"}, unknown.Suggestions["lnt"])
+	assert.Equal([]string{"test"}, unknown.Suggestions["tset"])
+	assert.Empty(unknown.Suggestions["deploy"])
+	assert.Contains(err.Error(), "unknown tasks lnt (did you mean lint?), tset (did you mean test?), deploy, registered tasks are build, ")
+}
+
+func TestRunTasksRunsSharedDependenciesOnce(t *testing.T) {
+	assert := assert.New(t)
+	executor := &MockExecutor{}
+	shared := &Task{ID: "pkg/gen", Kind: "gen", executor: executor}
+	tree := &ExecutionTree{
+		tasks: map[string]*Task{
+			"lint":  {ID: "pkg/lint", Kind: "lint", executor: executor, Dependencies: []*Task{shared}},
+			"test":  {ID: "pkg/test", Kind: "test", executor: executor, Dependencies: []*Task{shared}},
+			"build": {ID: "pkg/build", Kind: "build", executor: executor},
+		},
+	}
+	ctx := WithJobs(cfg.ConfigureContext(context.Background()), 1)
+	assert.NoError(tree.RunTasks(ctx, "lint", "test", "build"))
+	assert.Equal([]string{"gen", "lint", "test", "build"}, executor.executionOrder)
+}
+
+type argsExecutor struct {
+	mu   sync.Mutex
+	args map[string][]string
+}
+
+func (a *argsExecutor) Execute(ctx context.Context, kind string, opts json.RawMessage) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.args[kind] = GetArgsFromContext(ctx)
+	return nil
+}
+
+func TestRunTasksPassesArgsToEntryTasksOnly(t *testing.T) {
+	assert := assert.New(t)
+	executor := &argsExecutor{args: map[string][]string{}}
+	gen := &Task{ID: "pkg/gen", Kind: "gen", executor: executor}
+	test := &Task{ID: "pkg/test", Kind: "test", executor: executor, Dependencies: []*Task{gen}}
+	tree := &ExecutionTree{
+		tasks: map[string]*Task{"test": test},
+	}
+	ctx := WithJobs(keyContext(t.TempDir()), 1)
+	args := []string{"-run", "TestFoo", "-count=1"}
+	assert.NoError(tree.RunTasks(WithArgs(ctx, args), "test"))
+	assert.Equal(args, executor.args["test"])
+	assert.Nil(executor.args["gen"])
+
+	plain, err := tree.PlanTasks(ctx, "test")
+	assert.NoError(err)
+	withArgs, err := tree.PlanTasks(WithArgs(ctx, args), "test")
+	assert.NoError(err)
+	assert.Equal(plain.Groups[0][0].CacheKey, withArgs.Groups[0][0].CacheKey)
+	assert.NotEqual(plain.Groups[1][0].CacheKey, withArgs.Groups[1][0].CacheKey)
+}
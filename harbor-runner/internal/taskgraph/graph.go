@@ -0,0 +1,311 @@
+package taskgraph
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+)
+
+// Dependency is the task of another package a construct runs.
+type Dependency struct {
+	// Name is how the construct refers to the package, like its path.
+	Name   string
+	Config *packageconfig.Config
+	Tree   *ExecutionTree
+	Task   string
+}
+
+// DependencyResolver can be implemented by an Executor whose constructs run
+// tasks of other packages, so those tasks can be shown as part of the graph.
+// It returns nil for constructs that don't.
+type DependencyResolver interface {
+	ResolveDependency(ctx context.Context, kind string, opts json.RawMessage) (*Dependency, error)
+}
+
+// Graph is a task graph flattened for rendering. Nodes are listed in an order
+// they could run in.
+type Graph struct {
+	Roots []string    `json:"roots"`
+	Nodes []GraphNode `json:"nodes"`
+	// Edges go from a task to a task that needs it, so from what runs first to
+	// what runs after.
+	Edges []GraphEdge `json:"edges"`
+}
+
+type GraphNode struct {
+	// Key identifies the node in the graph, it is the construct ID prefixed
+	// with the local dependency the construct came from.
+	Key     string `json:"key"`
+	ID      string `json:"id"`
+	Kind    string `json:"kind"`
+	Options string `json:"options,omitempty"`
+	// Dependency is the local dependency the construct was defined in, empty
+	// for constructs of the package itself.
+	Dependency string `json:"dependency,omitempty"`
+}
+
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// TaskGraph returns the graph of the task registered as taskName. When
+// withDependencies is set the graphs of the local dependency tasks it runs are
+// included.
+func (e *ExecutionTree) TaskGraph(ctx context.Context, taskName string, withDependencies bool) (*Graph, error) {
+	tasks, err := e.LookupTasks(taskName)
+	if err != nil {
+		return nil, err
+	}
+	return buildGraph(ctx, tasks, withDependencies)
+}
+
+// SetupGraph returns the graph of the package's setup.
+func (e *ExecutionTree) SetupGraph(ctx context.Context, withDependencies bool) (*Graph, error) {
+	return buildGraph(ctx, e.setupTask.Dependencies, withDependencies)
+}
+
+// walkedTask is a task reached while walking a graph, along with the context
+// of the package it belongs to.
+type walkedTask struct {
+	ctx  context.Context
+	task *Task
+	// key identifies the task in the graph, it is the construct ID prefixed
+	// with the local dependency the construct came from.
+	key        string
+	dependency string
+	// needs are the keys of the tasks that must run before this one.
+	needs []string
+}
+
+// walk lists the tasks below roots so every task comes after the tasks it
+// needs. When withDependencies is set the tasks run in local dependencies are
+// walked as well.
+func walk(ctx context.Context, roots []*Task, withDependencies bool) ([]*walkedTask, []string, error) {
+	walked := []*walkedTask{}
+	rootKeys := []string{}
+	keys := map[*Task]string{}
+	var visit func(ctx context.Context, t *Task, dependency string) (string, error)
+	visit = func(ctx context.Context, t *Task, dependency string) (string, error) {
+		if key, ok := keys[t]; ok {
+			return key, nil
+		}
+		key := t.ID
+		if dependency != "" {
+			key = fmt.Sprintf("%s:%s", dependency, t.ID)
+		}
+		keys[t] = key
+		node := &walkedTask{
+			ctx:        ctx,
+			task:       t,
+			key:        key,
+			dependency: dependency,
+			needs:      []string{},
+		}
+		for _, dep := range t.Dependencies {
+			depKey, err := visit(ctx, dep, dependency)
+			if err != nil {
+				return "", err
+			}
+			node.needs = append(node.needs, depKey)
+		}
+		resolver, ok := t.executor.(DependencyResolver)
+		if withDependencies && ok {
+			resolved, err := resolver.ResolveDependency(context.WithValue(ctx, _TASK_CONTEXT_KEY, t), t.Kind, t.Options)
+			if err != nil {
+				return "", errors.Wrapf(err, "failed to resolve the dependency of %s", t.ID)
+			}
+			if resolved != nil {
+				task, ok := resolved.Tree.tasks[resolved.Task]
+				if !ok {
+					return "", fmt.Errorf("%s runs task %s of %s, which does not exist", t.ID, resolved.Task, resolved.Name)
+				}
+				depKey, err := visit(resolved.Config.ConfigureContext(ctx), task, resolved.Name)
+				if err != nil {
+					return "", err
+				}
+				node.needs = append(node.needs, depKey)
+			}
+		}
+		walked = append(walked, node)
+		return key, nil
+	}
+	for _, root := range roots {
+		key, err := visit(ctx, root, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		rootKeys = append(rootKeys, key)
+	}
+	return walked, rootKeys, nil
+}
+
+func buildGraph(ctx context.Context, roots []*Task, withDependencies bool) (*Graph, error) {
+	walked, rootKeys, err := walk(ctx, roots, withDependencies)
+	if err != nil {
+		return nil, err
+	}
+	graph := &Graph{
+		Roots: rootKeys,
+		Nodes: []GraphNode{},
+		Edges: []GraphEdge{},
+	}
+	for _, node := range walked {
+		for _, need := range node.needs {
+			graph.Edges = append(graph.Edges, GraphEdge{From: need, To: node.key})
+		}
+		graph.Nodes = append(graph.Nodes, GraphNode{
+			Key:        node.key,
+			ID:         node.task.ID,
+			Kind:       node.task.Kind,
+			Options:    summarizeOptions(node.task.Options),
+			Dependency: node.dependency,
+		})
+	}
+	return graph, nil
+}
+
+const maxOptionsSummary = 60
+
+// summarizeOptions describes options in a line short enough for a graph
+// label, commands are shown as they would be typed.
+func summarizeOptions(raw json.RawMessage) string {
+	opts := map[string]json.RawMessage{}
+	if len(raw) == 0 || json.Unmarshal(raw, &opts) != nil {
+		return ""
+	}
+	summary := ""
+	var executable string
+	var shell string
+	var run string
+	if json.Unmarshal(opts["executable"], &executable) == nil && executable != "" {
+		args := []string{}
+		json.Unmarshal(opts["args"], &args)
+		summary = strings.Join(append([]string{executable}, args...), " ")
+	} else if json.Unmarshal(opts["shell"], &shell) == nil && shell != "" {
+		summary = fmt.Sprintf("sh: %s", strings.Join(strings.Fields(shell), " "))
+	} else if json.Unmarshal(opts["run"], &run) == nil && run != "" {
+		summary = fmt.Sprintf("run %s", run)
+	} else {
+		keys := make([]string, 0, len(opts))
+		for key := range opts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := []string{}
+		for _, key := range keys {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", key, opts[key]))
+		}
+		summary = strings.Join(pairs, " ")
+	}
+	if runes := []rune(summary); len(runes) > maxOptionsSummary {
+		summary = string(runes[:maxOptionsSummary-3]) + "..."
+	}
+	return summary
+}
+
+// dependencies groups the nodes by the local dependency they came from, the
+// package's own nodes come first.
+func (g *Graph) dependencies() ([]string, map[string][]GraphNode) {
+	names := []string{}
+	nodes := map[string][]GraphNode{}
+	for _, node := range g.Nodes {
+		if _, ok := nodes[node.Dependency]; !ok {
+			names = append(names, node.Dependency)
+		}
+		nodes[node.Dependency] = append(nodes[node.Dependency], node)
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return names[i] == ""
+	})
+	return names, nodes
+}
+
+func (n GraphNode) labelLines() []string {
+	lines := []string{n.ID, n.Kind}
+	if n.Options != "" {
+		lines = append(lines, n.Options)
+	}
+	return lines
+}
+
+// WriteDOT renders the graph for Graphviz. Constructs of local dependencies
+// are drawn in a cluster per dependency.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace
+	quote := func(lines ...string) string {
+		escaped := []string{}
+		for _, line := range lines {
+			escaped = append(escaped, escape(line))
+		}
+		return `"` + strings.Join(escaped, `\n`) + `"`
+	}
+	b := &strings.Builder{}
+	fmt.Fprintln(b, "digraph harbor {")
+	fmt.Fprintln(b, "  rankdir=LR;")
+	fmt.Fprintln(b, "  node [shape=box];")
+	names, nodes := g.dependencies()
+	for i, name := range names {
+		indent := "  "
+		if name != "" {
+			fmt.Fprintf(b, "  subgraph cluster_%d {\n", i)
+			fmt.Fprintf(b, "    label=%s;\n", quote(name))
+			indent = "    "
+		}
+		for _, node := range nodes[name] {
+			fmt.Fprintf(b, "%s%s [label=%s];\n", indent, quote(node.Key), quote(node.labelLines()...))
+		}
+		if name != "" {
+			fmt.Fprintln(b, "  }")
+		}
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(b, "  %s -> %s;\n", quote(edge.From), quote(edge.To))
+	}
+	fmt.Fprintln(b, "}")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteMermaid renders the graph as a Mermaid flowchart. Mermaid is picky
+// about node IDs, so nodes are numbered and labelled with their construct.
+func (g *Graph) WriteMermaid(w io.Writer) error {
+	label := func(lines []string) string {
+		escaped := []string{}
+		for _, line := range lines {
+			escaped = append(escaped, strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace(line))
+		}
+		return `"` + strings.Join(escaped, "<br/>") + `"`
+	}
+	ids := map[string]string{}
+	for i, node := range g.Nodes {
+		ids[node.Key] = fmt.Sprintf("n%d", i)
+	}
+	b := &strings.Builder{}
+	fmt.Fprintln(b, "flowchart LR")
+	names, nodes := g.dependencies()
+	for i, name := range names {
+		indent := "  "
+		if name != "" {
+			fmt.Fprintf(b, "  subgraph d%d [%s]\n", i, label([]string{name}))
+			indent = "    "
+		}
+		for _, node := range nodes[name] {
+			fmt.Fprintf(b, "%s%s[%s]\n", indent, ids[node.Key], label(node.labelLines()))
+		}
+		if name != "" {
+			fmt.Fprintln(b, "  end")
+		}
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(b, "  %s --> %s\n", ids[edge.From], ids[edge.To])
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
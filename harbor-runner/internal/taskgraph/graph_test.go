@@ -0,0 +1,73 @@
+package taskgraph
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/radding/harbor-runner/internal/cache"
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+	"github.com/stretchr/testify/assert"
+)
+
+// resolvingExecutor runs the "build" task of dep for every RemoteTask.
+type resolvingExecutor struct {
+	MockExecutor
+	dep *Dependency
+}
+
+func (r *resolvingExecutor) ResolveDependency(ctx context.Context, kind string, opts json.RawMessage) (*Dependency, error) {
+	if kind != "harbor.dev/RemoteTask" {
+		return nil, nil
+	}
+	return r.dep, nil
+}
+
+func TestTaskGraphIncludesLocalDependencies(t *testing.T) {
+	assert := assert.New(t)
+	executor := &resolvingExecutor{}
+
+	lib := packageconfig.NewConfig(&cache.NonCache{})
+	lib.Constructs = map[string]packageconfig.Construct{
+		"lib/build": {Kind: "harbor.dev/ExecCommand", Options: json.RawMessage(`{"executable":"go","args":["build","./..."]}`)},
+	}
+	lib.Tasks = map[string]string{"build": "lib/build"}
+	libTree, err := CreateTreeFromConfig(lib, executor)
+	assert.NoError(err)
+	executor.dep = &Dependency{Name: "../lib", Config: lib, Tree: libTree, Task: "build"}
+
+	app := packageconfig.NewConfig(&cache.NonCache{})
+	app.Constructs = map[string]packageconfig.Construct{
+		"app/lib":   {Kind: "harbor.dev/RemoteTask", Options: json.RawMessage(`{"run":"build"}`)},
+		"app/build": {Kind: "harbor.dev/ExecCommand", DependsOn: []string{"app/lib"}},
+	}
+	app.Tasks = map[string]string{"build": "app/build"}
+	appTree, err := CreateTreeFromConfig(app, executor)
+	assert.NoError(err)
+
+	graph, err := appTree.TaskGraph(app.ConfigureContext(context.Background()), "build", true)
+	assert.NoError(err)
+	assert.Equal([]string{"app/build"}, graph.Roots)
+	assert.Equal([]GraphNode{
+		{Key: "../lib:lib/build", ID: "lib/build", Kind: "harbor.dev/ExecCommand", Options: "go build ./...", Dependency: "../lib"},
+		{Key: "app/lib", ID: "app/lib", Kind: "harbor.dev/RemoteTask", Options: "run build"},
+		{Key: "app/build", ID: "app/build", Kind: "harbor.dev/ExecCommand"},
+	}, graph.Nodes)
+	assert.Equal([]GraphEdge{
+		{From: "../lib:lib/build", To: "app/lib"},
+		{From: "app/lib", To: "app/build"},
+	}, graph.Edges)
+
+	dot := &bytes.Buffer{}
+	assert.NoError(graph.WriteDOT(dot))
+	assert.Contains(dot.String(), `label="../lib";`)
+	assert.Contains(dot.String(), `"app/lib" -> "app/build";`)
+	mermaid := &bytes.Buffer{}
+	assert.NoError(graph.WriteMermaid(mermaid))
+	assert.Contains(mermaid.String(), "n1 --> n2")
+
+	graph, err = appTree.TaskGraph(app.ConfigureContext(context.Background()), "build", false)
+	assert.NoError(err)
+	assert.Len(graph.Nodes, 2)
+}
@@ -0,0 +1,99 @@
+package taskgraph
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const _HISTORY_CONTEXT_KEY = schedulerContextKeyType("HISTORY")
+
+// historyWeight is how much the latest run counts towards a task's expected
+// duration, the rest comes from the runs before it.
+const historyWeight = 0.5
+
+// History keeps how long tasks took in previous runs, so the tasks starting
+// the longest chains can be started first.
+type History struct {
+	mu    sync.Mutex
+	path  string
+	Tasks map[string]taskHistory `json:"tasks"`
+}
+
+type taskHistory struct {
+	// Duration is the expected duration of the task, weighted towards its
+	// latest runs.
+	Duration time.Duration `json:"duration"`
+	Runs     int           `json:"runs"`
+}
+
+// LoadHistory reads the history kept at path, it is empty when there is none
+// yet or it can't be read.
+func LoadHistory(path string) *History {
+	h := &History{
+		path:  path,
+		Tasks: map[string]taskHistory{},
+	}
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		return h
+	}
+	if err := json.Unmarshal(bts, h); err != nil || h.Tasks == nil {
+		h.Tasks = map[string]taskHistory{}
+	}
+	return h
+}
+
+// WithHistory makes the task graphs executed with ctx start the tasks with the
+// longest expected chains first.
+func WithHistory(ctx context.Context, h *History) context.Context {
+	return context.WithValue(ctx, _HISTORY_CONTEXT_KEY, h)
+}
+
+func historyFromContext(ctx context.Context) *History {
+	h, _ := ctx.Value(_HISTORY_CONTEXT_KEY).(*History)
+	return h
+}
+
+// expected returns how long the task is expected to take, zero when it never
+// ran.
+func (h *History) expected(id string) time.Duration {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.Tasks[id].Duration
+}
+
+// Record adds the tasks of a run to the history. Only tasks that ran and
+// succeeded count, a replay from the cache or a task that failed early would
+// make a slow task look fast.
+func (h *History) Record(timings *Timings) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, timing := range timings.timed() {
+		if timing.Replayed || timing.Failed {
+			continue
+		}
+		past, ok := h.Tasks[timing.ID]
+		if !ok {
+			past.Duration = timing.Duration()
+		} else {
+			past.Duration = time.Duration(historyWeight*float64(timing.Duration()) + (1-historyWeight)*float64(past.Duration))
+		}
+		past.Runs++
+		h.Tasks[timing.ID] = past
+	}
+}
+
+// Save writes the history back to where it was loaded from.
+func (h *History) Save() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return errors.Wrap(writeJSON(h.path, h), "failed to save the task history")
+}
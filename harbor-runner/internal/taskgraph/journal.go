@@ -0,0 +1,138 @@
+package taskgraph
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const _JOURNAL_CONTEXT_KEY = schedulerContextKeyType("JOURNAL")
+
+// Journal records the tasks of a run that succeeded as they do, so a run that
+// was interrupted can be resumed without running them again. Tasks are
+// recorded by cache key, a task only counts as done while its key matches.
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	// Tasks, Args and Params are what the run was asked to do.
+	Tasks  []string          `json:"tasks"`
+	Args   []string          `json:"args,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+	// Succeeded maps the cache keys of the tasks that succeeded to their IDs.
+	Succeeded map[string]string `json:"succeeded"`
+}
+
+// NewJournal starts the journal of a run at path, replacing the journal of
+// the previous run.
+func NewJournal(path string, tasks, args []string, params map[string]string) (*Journal, error) {
+	j := &Journal{
+		path:      path,
+		Tasks:     tasks,
+		Args:      args,
+		Params:    params,
+		Succeeded: map[string]string{},
+	}
+	return j, j.save()
+}
+
+// ResumeJournal opens the journal of the interrupted run at path, the tasks
+// it recorded are skipped by the run resuming it.
+func ResumeJournal(path string) (*Journal, error) {
+	bts, err := os.ReadFile(path)
+	if err != nil && os.IsNotExist(err) {
+		return nil, errors.New("there is no interrupted run to resume")
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read the journal of the last run")
+	}
+	j := &Journal{}
+	if err := json.Unmarshal(bts, j); err != nil {
+		return nil, errors.Wrap(err, "failed to parse the journal of the last run")
+	}
+	j.path = path
+	if j.Succeeded == nil {
+		j.Succeeded = map[string]string{}
+	}
+	return j, nil
+}
+
+// WithJournal makes every task graph executed with ctx record its tasks in j,
+// and skip the tasks j already has.
+func WithJournal(ctx context.Context, j *Journal) context.Context {
+	return context.WithValue(ctx, _JOURNAL_CONTEXT_KEY, j)
+}
+
+func journalFromContext(ctx context.Context) (*Journal, bool) {
+	j, ok := ctx.Value(_JOURNAL_CONTEXT_KEY).(*Journal)
+	return j, ok
+}
+
+// succeeded reports whether the task with the given key already succeeded.
+func (j *Journal) succeeded(key string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, ok := j.Succeeded[key]
+	return ok
+}
+
+// record writes down that the task succeeded, right away so the run can be
+// resumed however it ends.
+func (j *Journal) record(t *Task, key string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Succeeded[key] = t.ID
+	if err := j.saveLocked(); err != nil {
+		slog.Warn("failed to save the run journal", slog.String("error", err.Error()))
+	}
+}
+
+// Finish removes the journal, the run completed and there is nothing left to
+// resume.
+func (j *Journal) Finish() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := os.Remove(j.path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove the run journal")
+	}
+	return nil
+}
+
+func (j *Journal) save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.saveLocked()
+}
+
+func (j *Journal) saveLocked() error {
+	return errors.Wrap(writeJSON(j.path, j), "failed to save the run journal")
+}
+
+// writeJSON writes v to a temporary file first, so an interrupted write
+// leaves the previous contents of path intact.
+func writeJSON(path string, v any) error {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0744); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bts); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,46 @@
+package taskgraph
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumedRunSkipsTasksThatSucceeded(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "runs", "last.json")
+	chain := func(executor Executor) *Task {
+		first := &Task{ID: "first", Kind: "first", executor: executor}
+		flaky := &Task{ID: "flaky", Kind: "flaky", executor: executor, Dependencies: []*Task{first}}
+		return &Task{ID: "last", Kind: "last", executor: executor, Dependencies: []*Task{flaky}}
+	}
+
+	failing := &MockExecutor{
+		mockFunc: func(kind string) error {
+			if kind == "flaky" {
+				return errors.New("interrupted")
+			}
+			return nil
+		},
+	}
+	journal, err := NewJournal(path, []string{"last"}, nil, nil)
+	assert.NoError(err)
+	ctx := WithJobs(cfg.ConfigureContext(context.Background()), 1)
+	assert.Error(chain(failing).Execute(WithJournal(ctx, journal)))
+	assert.Equal([]string{"first", "flaky"}, failing.executionOrder)
+
+	resumed, err := ResumeJournal(path)
+	assert.NoError(err)
+	assert.Equal([]string{"last"}, resumed.Tasks)
+	assert.Len(resumed.Succeeded, 1)
+	executor := &MockExecutor{}
+	assert.NoError(chain(executor).Execute(WithJournal(ctx, resumed)))
+	assert.Equal([]string{"flaky", "last"}, executor.executionOrder)
+
+	assert.NoError(resumed.Finish())
+	_, err = ResumeJournal(path)
+	assert.ErrorContains(err, "no interrupted run")
+}
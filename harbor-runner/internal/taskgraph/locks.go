@@ -0,0 +1,190 @@
+package taskgraph
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+)
+
+const _LOCKS_CONTEXT_KEY = schedulerContextKeyType("LOCKS")
+const _HELD_LOCKS_CONTEXT_KEY = schedulerContextKeyType("HELD_LOCKS")
+
+// lock is a resource a task holds while it runs, like a port it binds. A task
+// takes Weight units of the resource, which has as many units as its package
+// declares and a single one otherwise.
+type lock struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+// UnmarshalJSON accepts either the name of the resource, taking one unit of
+// it, or a name and a weight.
+func (l *lock) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*l = lock{Name: name, Weight: 1}
+		return nil
+	}
+	type plain lock
+	parsed := plain{Weight: 1}
+	if err := json.Unmarshal(b, &parsed); err != nil {
+		return fmt.Errorf("expected a resource name or a name and a weight, got %s", b)
+	}
+	*l = lock(parsed)
+	return nil
+}
+
+// resource is a weighted semaphore tasks take units of.
+type resource struct {
+	name     string
+	capacity int
+	mu       sync.Mutex
+	used     int
+	// released is closed, and replaced, whenever units are given back.
+	released chan struct{}
+}
+
+func (r *resource) tryAcquire(weight int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.used+weight > r.capacity {
+		return false
+	}
+	r.used += weight
+	return true
+}
+
+func (r *resource) acquire(ctx context.Context, weight int) error {
+	for {
+		r.mu.Lock()
+		if r.used+weight <= r.capacity {
+			r.used += weight
+			r.mu.Unlock()
+			return nil
+		}
+		released := r.released
+		r.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+func (r *resource) release(weight int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.used -= weight
+	close(r.released)
+	r.released = make(chan struct{})
+}
+
+// resources hands out the resources of a run. It is shared through the
+// context like the pool, so tasks of local dependencies take the same locks.
+type resources struct {
+	mu        sync.Mutex
+	resources map[string]*resource
+}
+
+func withResources(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(_LOCKS_CONTEXT_KEY).(*resources); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, _LOCKS_CONTEXT_KEY, &resources{
+		resources: map[string]*resource{},
+	})
+}
+
+// get returns the resource called name. Its capacity is the one declared by
+// the package of the first task taking it.
+func (r *resources) get(ctx context.Context, name string) *resource {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if res, ok := r.resources[name]; ok {
+		return res
+	}
+	capacity := 1
+	if cfg, err := packageconfig.ExtractConfigFromContext(ctx); err == nil && cfg.Resources[name] > 0 {
+		capacity = cfg.Resources[name]
+	}
+	res := &resource{
+		name:     name,
+		capacity: capacity,
+		released: make(chan struct{}),
+	}
+	r.resources[name] = res
+	return res
+}
+
+// acquireLocks takes the locks of the task, in the order of their names so
+// tasks waiting for each other's locks can't deadlock. A task waiting for a
+// lock gives up its slot until it has them all. Locks held by the task that
+// started this graph are already the task's. The returned context records the
+// held locks for the graphs the task runs.
+func (t *Task) acquireLocks(ctx context.Context, p *pool) (context.Context, func(), error) {
+	opts, err := t.parseOptions()
+	if err != nil || len(opts.Locks) == 0 {
+		return ctx, func() {}, err
+	}
+	registry, ok := ctx.Value(_LOCKS_CONTEXT_KEY).(*resources)
+	if !ok {
+		return ctx, func() {}, nil
+	}
+	held, _ := ctx.Value(_HELD_LOCKS_CONTEXT_KEY).(map[string]bool)
+	locks := []lock{}
+	for _, l := range opts.Locks {
+		if !held[l.Name] {
+			locks = append(locks, l)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Name < locks[j].Name
+	})
+
+	taken := []lock{}
+	release := func() {
+		for _, l := range taken {
+			registry.get(ctx, l.Name).release(l.Weight)
+		}
+	}
+	waiting := false
+	for _, l := range locks {
+		res := registry.get(ctx, l.Name)
+		if l.Weight > res.capacity {
+			release()
+			return ctx, nil, fmt.Errorf("%s needs %d of %s, which only has %d", t.ID, l.Weight, l.Name, res.capacity)
+		}
+		if !res.tryAcquire(l.Weight) {
+			if !waiting {
+				slog.Debug("waiting for lock", slog.String("task_id", t.ID), slog.String("lock", l.Name))
+				waiting = true
+				p.release()
+			}
+			if err := res.acquire(ctx, l.Weight); err != nil {
+				release()
+				p.acquire()
+				return ctx, nil, errors.Wrapf(err, "%s was waiting for %s", t.ID, l.Name)
+			}
+		}
+		taken = append(taken, l)
+	}
+	if waiting {
+		p.acquire()
+	}
+
+	nowHeld := map[string]bool{}
+	for name := range held {
+		nowHeld[name] = true
+	}
+	for _, l := range taken {
+		nowHeld[l.Name] = true
+	}
+	return context.WithValue(ctx, _HELD_LOCKS_CONTEXT_KEY, nowHeld), release, nil
+}
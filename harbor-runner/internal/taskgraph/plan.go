@@ -0,0 +1,254 @@
+package taskgraph
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/radding/harbor-runner/internal/cache"
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+)
+
+// CacheStatus tells whether a task would be replayed from the cache.
+type CacheStatus string
+
+const (
+	CacheHit  CacheStatus = "hit"
+	CacheMiss CacheStatus = "miss"
+	// NotCached tasks run every time, their kind keeps nothing in the cache.
+	NotCached CacheStatus = "uncached"
+)
+
+// CacheProber can be implemented by an Executor to tell whether a task would
+// be replayed from the cache, without running it. The context holds the
+// task's cache, like it does for Execute.
+type CacheProber interface {
+	ProbeCache(ctx context.Context, kind string, opts json.RawMessage) (CacheStatus, error)
+}
+
+// PlanStep is a task a run would execute.
+type PlanStep struct {
+	Key        string      `json:"key"`
+	ID         string      `json:"id"`
+	Kind       string      `json:"kind"`
+	Dependency string      `json:"dependency,omitempty"`
+	Needs      []string    `json:"needs"`
+	CacheKey   string      `json:"cacheKey"`
+	Cache      CacheStatus `json:"cache"`
+	// Reason explains the cache status, like which input changed.
+	Reason string `json:"reason"`
+}
+
+// Plan lists the tasks a run would execute in groups. A group only needs tasks
+// of the groups before it, so all of its tasks can run in parallel.
+type Plan struct {
+	Groups [][]PlanStep `json:"groups"`
+}
+
+// PlanTasks returns what running the tasks registered as taskNames would do,
+// without running anything.
+func (e *ExecutionTree) PlanTasks(ctx context.Context, taskNames ...string) (*Plan, error) {
+	tasks, err := e.LookupTasks(taskNames...)
+	if err != nil {
+		return nil, err
+	}
+	return buildPlan(ctx, tasks)
+}
+
+// PlanSetup returns what running the package setup would do.
+func (e *ExecutionTree) PlanSetup(ctx context.Context) (*Plan, error) {
+	return buildPlan(ctx, e.setupTask.Dependencies)
+}
+
+func buildPlan(ctx context.Context, roots []*Task) (*Plan, error) {
+	ctx = bindArgs(withKeyer(ctx), roots)
+	walked, _, err := walk(ctx, roots, true)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{
+		Groups: [][]PlanStep{},
+	}
+	groups := map[string]int{}
+	history := map[*cache.Store][]*cache.Entry{}
+	for _, node := range walked {
+		group := 0
+		for _, need := range node.needs {
+			group = max(group, groups[need]+1)
+		}
+		groups[node.key] = group
+		step, err := planStep(node, history)
+		if err != nil {
+			return nil, err
+		}
+		if group == len(plan.Groups) {
+			plan.Groups = append(plan.Groups, []PlanStep{})
+		}
+		plan.Groups[group] = append(plan.Groups[group], step)
+	}
+	return plan, nil
+}
+
+func planStep(node *walkedTask, history map[*cache.Store][]*cache.Entry) (PlanStep, error) {
+	t := node.task
+	step := PlanStep{
+		Key:        node.key,
+		ID:         t.ID,
+		Kind:       t.Kind,
+		Dependency: node.dependency,
+		Needs:      node.needs,
+		Cache:      NotCached,
+	}
+	ctx, err := t.prepare(node.ctx)
+	if err != nil {
+		return step, errors.Wrapf(err, "failed to plan %s", t.ID)
+	}
+	step.CacheKey, _ = t.CacheKey(ctx)
+	inputs, _ := t.CacheKeyInputs(ctx)
+
+	if prober, ok := t.executor.(CacheProber); ok {
+		step.Cache, err = prober.ProbeCache(ctx, t.Kind, t.Options)
+		if err != nil {
+			return step, errors.Wrapf(err, "failed to check the cache of %s", t.ID)
+		}
+	}
+	switch step.Cache {
+	case CacheHit:
+		step.Reason = fmt.Sprintf("cached under key %s", step.CacheKey[:12])
+	case CacheMiss:
+		cfg, err := packageconfig.ExtractConfigFromContext(ctx)
+		if err != nil {
+			return step, err
+		}
+		step.Reason, err = explainMiss(cfg.GetStore(), history, t.ID, step.CacheKey, inputs)
+		if err != nil {
+			return step, err
+		}
+	default:
+		step.Reason = fmt.Sprintf("%s is not cached, it always runs", t.Kind)
+	}
+	return step, nil
+}
+
+// explainMiss compares the inputs of a task's key with those of the entry the
+// task last used, to tell what changed since.
+func explainMiss(store *cache.Store, history map[*cache.Store][]*cache.Entry, taskID, key string, inputs *KeyInputs) (string, error) {
+	if store == nil {
+		return "no cached result", nil
+	}
+	entries, ok := history[store]
+	if !ok {
+		var err error
+		entries, err = store.Entries()
+		if err != nil {
+			return "", errors.Wrap(err, "failed to list cache entries")
+		}
+		history[store] = entries
+	}
+	var previous *cache.Entry
+	for _, entry := range entries {
+		if path.Dir(entry.Namespace) != path.Join("tasks", taskID) {
+			continue
+		}
+		if path.Base(entry.Namespace) == key {
+			return "the cached result for this key is incomplete", nil
+		}
+		if len(entry.KeyInputs) > 0 && (previous == nil || entry.LastAccess.After(previous.LastAccess)) {
+			previous = entry
+		}
+	}
+	if previous == nil {
+		return "no cached result for this task yet", nil
+	}
+	last := &KeyInputs{}
+	if err := json.Unmarshal(previous.KeyInputs, last); err != nil {
+		return "no readable cached result for this task", nil
+	}
+	return strings.Join(diffKeyInputs(last, inputs), ", "), nil
+}
+
+const maxChangesListed = 3
+
+func diffKeyInputs(last, current *KeyInputs) []string {
+	changes := []string{}
+	if last.Kind != current.Kind {
+		changes = append(changes, fmt.Sprintf("kind changed from %s to %s", last.Kind, current.Kind))
+	}
+	if last.Platform != current.Platform {
+		changes = append(changes, fmt.Sprintf("platform changed from %s to %s", last.Platform, current.Platform))
+	}
+	if !bytes.Equal(last.Options, current.Options) {
+		changes = append(changes, "options changed")
+	}
+	changes = append(changes, diffDigests("parameter", last.Params, current.Params)...)
+	if !slices.Equal(last.Args, current.Args) {
+		changes = append(changes, "arguments changed")
+	}
+	changes = append(changes, diffDigests("input", last.Inputs, current.Inputs)...)
+	if last.Fingerprint != current.Fingerprint {
+		changes = append(changes, "fingerprint changed")
+	}
+	changes = append(changes, diffDigests("dependency", last.Dependencies, current.Dependencies)...)
+	if len(changes) == 0 {
+		return []string{"the cache key format changed"}
+	}
+	return changes
+}
+
+// diffDigests lists what was added, removed or changed between two maps of
+// names to digests, at most a few of them.
+func diffDigests(what string, last, current map[string]string) []string {
+	changes := []string{}
+	for _, name := range sortedKeys(current) {
+		digest, ok := last[name]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("%s %s was added", what, name))
+		} else if digest != current[name] {
+			changes = append(changes, fmt.Sprintf("%s %s changed", what, name))
+		}
+	}
+	for _, name := range sortedKeys(last) {
+		if _, ok := current[name]; !ok {
+			changes = append(changes, fmt.Sprintf("%s %s was removed", what, name))
+		}
+	}
+	sort.Strings(changes)
+	if len(changes) > maxChangesListed {
+		more := len(changes) - maxChangesListed
+		changes = append(changes[:maxChangesListed], fmt.Sprintf("%d more %s changes", more, what))
+	}
+	return changes
+}
+
+// Steps returns how many tasks the plan runs.
+func (p *Plan) Steps() int {
+	steps := 0
+	for _, group := range p.Groups {
+		steps += len(group)
+	}
+	return steps
+}
+
+// WriteText renders the plan as a table per group.
+func (p *Plan) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i, group := range p.Groups {
+		if len(group) > 1 {
+			fmt.Fprintf(tw, "group %d, %d tasks in parallel\n", i+1, len(group))
+		} else {
+			fmt.Fprintf(tw, "group %d\n", i+1)
+		}
+		for _, step := range group {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", step.Cache, step.Key, step.Kind, step.Reason)
+		}
+	}
+	return tw.Flush()
+}
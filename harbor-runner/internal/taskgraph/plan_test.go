@@ -0,0 +1,94 @@
+package taskgraph
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/radding/harbor-runner/internal/cache"
+	packageconfig "github.com/radding/harbor-runner/internal/package-config"
+	"github.com/stretchr/testify/assert"
+)
+
+// probingExecutor reports the kinds in hits as cached, ExecCommands as misses
+// and everything else as not cached.
+type probingExecutor struct {
+	MockExecutor
+	hits map[string]bool
+}
+
+func (p *probingExecutor) ProbeCache(ctx context.Context, kind string, opts json.RawMessage) (CacheStatus, error) {
+	task, err := GetTaskFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	if p.hits[task.ID] {
+		return CacheHit, nil
+	}
+	if kind == "harbor.dev/ExecCommand" {
+		return CacheMiss, nil
+	}
+	return NotCached, nil
+}
+
+func TestPlanGroupsTasksThatCanRunInParallel(t *testing.T) {
+	assert := assert.New(t)
+	executor := &probingExecutor{hits: map[string]bool{"pkg/gen": true}}
+	c := packageconfig.NewConfig(&cache.NonCache{})
+	c.Constructs = map[string]packageconfig.Construct{
+		"pkg/gen":   {Kind: "harbor.dev/ExecCommand"},
+		"pkg/lint":  {Kind: "harbor.dev/ExecCommand"},
+		"pkg/build": {Kind: "harbor.dev/ExecCommand", DependsOn: []string{"pkg/gen"}},
+		"pkg/all":   {Kind: "harbor.dev/noop", DependsOn: []string{"pkg/build", "pkg/lint"}},
+	}
+	c.Tasks = map[string]string{"all": "pkg/all"}
+	tree, err := CreateTreeFromConfig(c, executor)
+	assert.NoError(err)
+
+	plan, err := tree.PlanTasks(c.ConfigureContext(context.Background()), "all")
+	assert.NoError(err)
+	assert.Empty(executor.executionOrder)
+	assert.Equal(4, plan.Steps())
+	groups := map[string]int{}
+	status := map[string]CacheStatus{}
+	for i, group := range plan.Groups {
+		for _, step := range group {
+			groups[step.ID] = i
+			status[step.ID] = step.Cache
+		}
+	}
+	assert.Equal(map[string]int{"pkg/gen": 0, "pkg/lint": 0, "pkg/build": 1, "pkg/all": 2}, groups)
+	assert.Equal(map[string]CacheStatus{
+		"pkg/gen":   CacheHit,
+		"pkg/lint":  CacheMiss,
+		"pkg/build": CacheMiss,
+		"pkg/all":   NotCached,
+	}, status)
+	assert.Contains(plan.Groups[0][0].Reason, "cached under key")
+	assert.Equal("no cached result", plan.Groups[0][1].Reason)
+}
+
+func TestDiffKeyInputsExplainsWhatChanged(t *testing.T) {
+	assert := assert.New(t)
+	last := &KeyInputs{
+		Kind:         "harbor.dev/ExecCommand",
+		Platform:     "linux/amd64",
+		Options:      json.RawMessage(`{"executable":"go"}`),
+		Inputs:       map[string]string{"a.go": "1", "b.go": "2"},
+		Dependencies: map[string]string{"pkg/gen": "x"},
+	}
+	current := &KeyInputs{
+		Kind:         "harbor.dev/ExecCommand",
+		Platform:     "linux/amd64",
+		Options:      json.RawMessage(`{"executable":"go"}`),
+		Inputs:       map[string]string{"a.go": "3", "c.go": "4"},
+		Dependencies: map[string]string{"pkg/gen": "y"},
+	}
+	assert.Equal([]string{
+		"input a.go changed",
+		"input b.go was removed",
+		"input c.go was added",
+		"dependency pkg/gen changed",
+	}, diffKeyInputs(last, current))
+	assert.Equal([]string{"the cache key format changed"}, diffKeyInputs(last, last))
+}
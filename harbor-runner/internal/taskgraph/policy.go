@@ -0,0 +1,141 @@
+package taskgraph
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// policyOptions are the options that change how a task is run but not what it
+// produces, so they are left out of its cache key.
+var policyOptions = []string{"timeout", "retries", "backoff", "allowFailure", "locks", "priority"}
+
+// duration accepts either a duration string like "90s" or a number of seconds.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(b, &seconds); err == nil {
+		*d = duration(seconds * float64(time.Second))
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(b, &text); err != nil {
+		return fmt.Errorf("expected a duration like \"90s\" or a number of seconds, got %s", b)
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// backoff is how long to wait between the retries of a failed task. The wait
+// starts at Delay and is multiplied by Factor after every retry, up to
+// MaxDelay.
+type backoff struct {
+	Delay    duration `json:"delay"`
+	Factor   float64  `json:"factor"`
+	MaxDelay duration `json:"maxDelay"`
+}
+
+const defaultBackoffDelay = time.Second
+const defaultBackoffFactor = 2
+const defaultBackoffMaxDelay = time.Minute
+
+// wait returns how long to wait before the given retry, starting at zero.
+func (b backoff) wait(retry int) time.Duration {
+	delay := time.Duration(b.Delay)
+	if delay == 0 {
+		delay = defaultBackoffDelay
+	}
+	factor := b.Factor
+	if factor == 0 {
+		factor = defaultBackoffFactor
+	}
+	maxDelay := time.Duration(b.MaxDelay)
+	if maxDelay == 0 {
+		maxDelay = max(defaultBackoffMaxDelay, delay)
+	}
+	wait := float64(delay)
+	for i := 0; i < retry && wait < float64(maxDelay); i++ {
+		wait *= factor
+	}
+	return min(time.Duration(wait), maxDelay)
+}
+
+func (o taskOptions) validate() error {
+	if o.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if o.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+	if o.Backoff.Delay < 0 || o.Backoff.MaxDelay < 0 || o.Backoff.Factor < 0 {
+		return fmt.Errorf("backoff must not be negative")
+	}
+	seen := map[string]bool{}
+	for _, l := range o.Locks {
+		if l.Name == "" {
+			return fmt.Errorf("locks must have a name")
+		}
+		if l.Weight < 1 {
+			return fmt.Errorf("lock %s must have a weight of at least 1", l.Name)
+		}
+		if seen[l.Name] {
+			return fmt.Errorf("lock %s is listed more than once", l.Name)
+		}
+		seen[l.Name] = true
+	}
+	return nil
+}
+
+// allowsFailure reports whether the task failing should not fail the run.
+func (t *Task) allowsFailure() bool {
+	opts, err := t.parseOptions()
+	return err == nil && opts.AllowFailure
+}
+
+// execute runs the task's executor, giving it up to the task's timeout and
+// running it again when it fails as long as the task has retries left.
+func (t *Task) execute(ctx context.Context) error {
+	opts, err := t.parseOptions()
+	if err != nil {
+		return err
+	}
+	for retry := 0; ; retry++ {
+		err = t.attempt(ctx, time.Duration(opts.Timeout))
+		if err == nil || retry >= opts.Retries || ctx.Err() != nil {
+			return err
+		}
+		wait := opts.Backoff.wait(retry)
+		slog.Warn("task failed, retrying", slog.String("task_id", t.ID), slog.Int("retry", retry+1), slog.Int("retries", opts.Retries), slog.Duration("wait", wait), slog.String("error", err.Error()))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// attempt runs the task's executor once, cancelling it after timeout unless
+// timeout is zero.
+func (t *Task) attempt(ctx context.Context, timeout time.Duration) error {
+	if timeout == 0 {
+		return t.executor.Execute(ctx, t.Kind, t.Options)
+	}
+	timedOut := fmt.Errorf("%s timed out after %s", t.ID, timeout)
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, timedOut)
+	defer cancel()
+	err := t.executor.Execute(ctx, t.Kind, t.Options)
+	if err != nil && context.Cause(ctx) == timedOut {
+		// the executor's error stays the cause, like the exit code of a command
+		return errors.Wrapf(err, "%s timed out after %s", t.ID, timeout)
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package taskgraph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errCanceled = errors.New("command was canceled")
+
+// flakyExecutor fails the first failures runs of each task and blocks until
+// cancelled on kind "hang".
+type flakyExecutor struct {
+	failures int32
+	runs     atomic.Int32
+}
+
+func (f *flakyExecutor) Execute(ctx context.Context, kind string, opts json.RawMessage) error {
+	run := f.runs.Add(1)
+	if kind == "hang" {
+		<-ctx.Done()
+		return errCanceled
+	}
+	if kind == "flaky" && run <= f.failures {
+		return errors.New("connection reset by peer")
+	}
+	return nil
+}
+
+func TestRetriesOnlyRerunTheFailingTask(t *testing.T) {
+	assert := assert.New(t)
+	dependencies := &MockExecutor{}
+	executor := &flakyExecutor{failures: 2}
+	task := &Task{
+		ID:       "pkg/integration",
+		Kind:     "flaky",
+		Options:  json.RawMessage(`{"retries": 2, "backoff": {"delay": "1ms"}}`),
+		executor: executor,
+		Dependencies: []*Task{{
+			ID:       "pkg/build",
+			Kind:     "build",
+			executor: dependencies,
+		}},
+	}
+	assert.NoError(task.Execute(cfg.ConfigureContext(context.Background())))
+	assert.Equal(int32(3), executor.runs.Load())
+	assert.Equal([]string{"build"}, dependencies.executionOrder)
+
+	executor = &flakyExecutor{failures: 2}
+	task = &Task{
+		ID:       "pkg/integration",
+		Kind:     "flaky",
+		Options:  json.RawMessage(`{"retries": 1, "backoff": {"delay": "1ms"}}`),
+		executor: executor,
+	}
+	assert.ErrorContains(task.Execute(cfg.ConfigureContext(context.Background())), "connection reset by peer")
+	assert.Equal(int32(2), executor.runs.Load())
+}
+
+func TestTimeoutCancelsTheTask(t *testing.T) {
+	assert := assert.New(t)
+	executor := &flakyExecutor{}
+	task := &Task{
+		ID:       "pkg/hang",
+		Kind:     "hang",
+		Options:  json.RawMessage(`{"timeout": "20ms", "retries": 1, "backoff": {"delay": "1ms"}}`),
+		executor: executor,
+	}
+	start := time.Now()
+	err := task.Execute(cfg.ConfigureContext(context.Background()))
+	assert.ErrorContains(err, "pkg/hang timed out after 20ms: command was canceled")
+	assert.ErrorIs(err, errCanceled)
+	assert.Equal(int32(2), executor.runs.Load())
+	assert.Less(time.Since(start), time.Second)
+}
+
+func TestBackoffGrowsUpToItsMaximum(t *testing.T) {
+	assert := assert.New(t)
+	b := backoff{
+		Delay:    duration(time.Second),
+		Factor:   3,
+		MaxDelay: duration(10 * time.Second),
+	}
+	assert.Equal(time.Second, b.wait(0))
+	assert.Equal(3*time.Second, b.wait(1))
+	assert.Equal(9*time.Second, b.wait(2))
+	assert.Equal(10*time.Second, b.wait(3))
+	assert.Equal(2*time.Second, backoff{}.wait(1))
+}
+
+func TestPolicyOptionsAreNotPartOfTheKey(t *testing.T) {
+	assert := assert.New(t)
+	ctx := cfg.ConfigureContext(context.Background())
+	plain := &Task{ID: "pkg/test", Kind: "harbor.dev/ExecCommand", Options: json.RawMessage(`{"executable": "go"}`), executor: &MockExecutor{}}
+	withPolicy := &Task{ID: "pkg/test", Kind: "harbor.dev/ExecCommand", Options: json.RawMessage(`{"executable": "go", "timeout": 30, "retries": 3}`), executor: &MockExecutor{}}
+	plainKey, err := plain.CacheKey(ctx)
+	assert.NoError(err)
+	policyKey, err := withPolicy.CacheKey(ctx)
+	assert.NoError(err)
+	assert.Equal(plainKey, policyKey)
+
+	invalid := &Task{ID: "pkg/test", Options: json.RawMessage(`{"retries": -1}`), executor: &MockExecutor{}}
+	_, err = invalid.CacheKey(ctx)
+	assert.ErrorContains(err, "retries must not be negative")
+}
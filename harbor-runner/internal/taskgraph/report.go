@@ -0,0 +1,117 @@
+package taskgraph
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const _KEEP_GOING_CONTEXT_KEY = schedulerContextKeyType("KEEP_GOING")
+const _REPORT_CONTEXT_KEY = schedulerContextKeyType("REPORT")
+
+// WithKeepGoing makes a failed task only stop the tasks that need it, every
+// other task still runs.
+func WithKeepGoing(ctx context.Context, keepGoing bool) context.Context {
+	return context.WithValue(ctx, _KEEP_GOING_CONTEXT_KEY, keepGoing)
+}
+
+func keepGoingFromContext(ctx context.Context) bool {
+	keepGoing, _ := ctx.Value(_KEEP_GOING_CONTEXT_KEY).(bool)
+	return keepGoing
+}
+
+// TaskFailure is a task that failed during a run.
+type TaskFailure struct {
+	ID  string
+	Err error
+}
+
+// Report collects the failures of a run, across every task graph the run
+// executes.
+type Report struct {
+	mu sync.Mutex
+	// Failed are the tasks that failed the run.
+	Failed []TaskFailure
+	// Allowed are the tasks that failed but are allowed to.
+	Allowed []TaskFailure
+	// Skipped are the tasks that never started because a task failed.
+	Skipped []string
+}
+
+// WithReport adds a report to ctx that every task graph executed with it adds
+// its failures to.
+func WithReport(ctx context.Context) (context.Context, *Report) {
+	report := &Report{}
+	return context.WithValue(ctx, _REPORT_CONTEXT_KEY, report), report
+}
+
+func reportFromContext(ctx context.Context) *Report {
+	report, ok := ctx.Value(_REPORT_CONTEXT_KEY).(*Report)
+	if !ok {
+		return &Report{}
+	}
+	return report
+}
+
+func (r *Report) fail(id string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Failed = append(r.Failed, TaskFailure{ID: id, Err: err})
+}
+
+func (r *Report) allow(id string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Allowed = append(r.Allowed, TaskFailure{ID: id, Err: err})
+}
+
+func (r *Report) skip(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Skipped = append(r.Skipped, id)
+}
+
+// Empty reports whether nothing failed and every task ran.
+func (r *Report) Empty() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.Failed) == 0 && len(r.Allowed) == 0 && len(r.Skipped) == 0
+}
+
+func plural(count int, singular, plural string) string {
+	if count == 1 {
+		return fmt.Sprintf("%d %s", count, singular)
+	}
+	return fmt.Sprintf("%d %s", count, plural)
+}
+
+// Write prints every failure of the run.
+func (r *Report) Write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := &strings.Builder{}
+	writeFailures := func(failures []TaskFailure) {
+		for _, failure := range failures {
+			fmt.Fprintf(b, "  %s: %s\n", failure.ID, failure.Err)
+		}
+	}
+	if len(r.Failed) > 0 {
+		fmt.Fprintf(b, "%s failed:\n", plural(len(r.Failed), "task", "tasks"))
+		writeFailures(r.Failed)
+	}
+	if len(r.Allowed) > 0 {
+		verb := "are"
+		if len(r.Allowed) == 1 {
+			verb = "is"
+		}
+		fmt.Fprintf(b, "%s failed but %s allowed to:\n", plural(len(r.Allowed), "task", "tasks"), verb)
+		writeFailures(r.Allowed)
+	}
+	if len(r.Skipped) > 0 {
+		fmt.Fprintf(b, "%s did not run: %s\n", plural(len(r.Skipped), "task", "tasks"), strings.Join(r.Skipped, ", "))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,341 @@
+package taskgraph
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type schedulerContextKeyType string
+
+const _JOBS_CONTEXT_KEY = schedulerContextKeyType("JOBS")
+const _POOL_CONTEXT_KEY = schedulerContextKeyType("POOL")
+const _SLOT_CONTEXT_KEY = schedulerContextKeyType("SLOT")
+
+// WithJobs limits how many tasks run at the same time. Zero or less uses the
+// number of CPUs.
+func WithJobs(ctx context.Context, jobs int) context.Context {
+	return context.WithValue(ctx, _JOBS_CONTEXT_KEY, jobs)
+}
+
+func jobsFromContext(ctx context.Context) int {
+	jobs, ok := ctx.Value(_JOBS_CONTEXT_KEY).(int)
+	if !ok || jobs <= 0 {
+		return runtime.NumCPU()
+	}
+	return jobs
+}
+
+// pool hands out the slots tasks run in. It is shared through the context, so
+// the task graphs of dependencies run by a task stay within the same limit.
+type pool struct {
+	slots chan struct{}
+}
+
+func newPool(jobs int) *pool {
+	return &pool{
+		slots: make(chan struct{}, jobs),
+	}
+}
+
+func (p *pool) acquire() {
+	p.slots <- struct{}{}
+}
+
+func (p *pool) release() {
+	<-p.slots
+}
+
+// withPool returns the pool of ctx, creating one if there is none yet.
+func withPool(ctx context.Context) (context.Context, *pool) {
+	if p, ok := ctx.Value(_POOL_CONTEXT_KEY).(*pool); ok {
+		return ctx, p
+	}
+	p := newPool(jobsFromContext(ctx))
+	return context.WithValue(ctx, _POOL_CONTEXT_KEY, p), p
+}
+
+// taskState records the one execution of a task, however many schedulers
+// reach it.
+type taskState struct {
+	started bool
+	done    chan struct{}
+	err     error
+}
+
+var taskStatesMu sync.Mutex
+
+// runOnce executes the task unless it was already executed, or is being
+// executed by another scheduler, in which case it waits for that execution
+// and returns its result. Waiting, for the other execution or for the task's
+// locks, gives up the caller's slot so other tasks can use it.
+func (t *Task) runOnce(ctx context.Context, p *pool) error {
+	taskStatesMu.Lock()
+	if t.state == nil {
+		t.state = &taskState{
+			done: make(chan struct{}),
+		}
+	}
+	state := t.state
+	started := state.started
+	state.started = true
+	taskStatesMu.Unlock()
+
+	if started {
+		p.release()
+		<-state.done
+		p.acquire()
+		return state.err
+	}
+	journal, journaled := journalFromContext(ctx)
+	key := ""
+	if journaled {
+		// a key that can't be computed fails the task when it runs
+		key, _ = t.CacheKey(ctx)
+		if key != "" && journal.succeeded(key) {
+			slog.Info("skipping task, it succeeded in the interrupted run", slog.String("task_id", t.ID))
+			close(state.done)
+			return nil
+		}
+	}
+	ctx, unlock, err := t.acquireLocks(ctx, p)
+	if err != nil {
+		state.err = err
+		close(state.done)
+		return err
+	}
+	start := time.Now()
+	replayed := &atomic.Bool{}
+	state.err = t.run(context.WithValue(ctx, _REPLAYED_CONTEXT_KEY, replayed))
+	unlock()
+	if timings, ok := timingsFromContext(ctx); ok {
+		timings.record(t, start, time.Now(), replayed.Load(), state.err != nil)
+	}
+	if state.err == nil && journaled && key != "" {
+		journal.record(t, key)
+	}
+	close(state.done)
+	return state.err
+}
+
+type scheduledTask struct {
+	task *Task
+	// order is the task's position in a topological order of the graph.
+	order int
+	// priority is the task's priority option and chain how long the task and
+	// the slowest chain of tasks needing it are expected to take.
+	priority   int
+	chain      time.Duration
+	pending    int
+	dependents []*scheduledTask
+}
+
+// before reports whether n should start before other when both are ready:
+// higher priority first, then the longer expected chain, then the lower order.
+func (n *scheduledTask) before(other *scheduledTask) bool {
+	if n.priority != other.priority {
+		return n.priority > other.priority
+	}
+	if n.chain != other.chain {
+		return n.chain > other.chain
+	}
+	return n.order < other.order
+}
+
+// prioritize sets the priority and expected chain of the nodes, which are in
+// topological order.
+func prioritize(nodes []*scheduledTask, history *History) {
+	for i := len(nodes) - 1; i >= 0; i-- {
+		node := nodes[i]
+		if opts, err := node.task.parseOptions(); err == nil {
+			node.priority = opts.Priority
+		}
+		var slowest time.Duration
+		for _, dependent := range node.dependents {
+			slowest = max(slowest, dependent.chain)
+		}
+		node.chain = slowest + history.expected(node.task.ID)
+	}
+}
+
+type taskResult struct {
+	node *scheduledTask
+	err  error
+}
+
+// schedule orders the graph below roots so every task comes after all of its
+// dependencies.
+func schedule(roots ...*Task) []*scheduledTask {
+	nodes := map[*Task]*scheduledTask{}
+	ordered := []*scheduledTask{}
+	var visit func(t *Task) *scheduledTask
+	visit = func(t *Task) *scheduledTask {
+		if node, ok := nodes[t]; ok {
+			return node
+		}
+		node := &scheduledTask{
+			task: t,
+		}
+		nodes[t] = node
+		seen := map[*scheduledTask]bool{}
+		for _, dep := range t.Dependencies {
+			depNode := visit(dep)
+			if seen[depNode] {
+				continue
+			}
+			seen[depNode] = true
+			node.pending++
+			depNode.dependents = append(depNode.dependents, node)
+		}
+		node.order = len(ordered)
+		ordered = append(ordered, node)
+		return node
+	}
+	for _, root := range roots {
+		visit(root)
+	}
+	return ordered
+}
+
+// Execute runs the task once all of its dependencies ran. Tasks run in at most
+// as many parallel jobs as the context allows, each one exactly once. The
+// first failure stops anything new from starting, unless the context says to
+// keep going, in which case only the tasks needing the failed one are skipped.
+// Tasks that allow failure never stop anything. Tasks only run once they hold
+// their locks, so tasks sharing a resource never take more of it than it has.
+func (t *Task) Execute(ctx context.Context) error {
+	return executeGraph(ctx, t)
+}
+
+// executeGraph runs roots and everything they need as a single graph, so tasks
+// they share run once.
+func executeGraph(ctx context.Context, roots ...*Task) error {
+	ctx = bindArgs(withResources(withKeyer(ctx)), roots)
+	ctx, p := withPool(ctx)
+	if held, ok := ctx.Value(_SLOT_CONTEXT_KEY).(*pool); ok && held == p {
+		// The task that started this graph only waits for it, its slot is
+		// better used by the graph's own tasks.
+		p.release()
+		defer p.acquire()
+	}
+	if caller, ok := ctx.Value(_TASK_CONTEXT_KEY).(*Task); ok {
+		if timings, ok := timingsFromContext(ctx); ok {
+			began := time.Now()
+			defer func() {
+				timings.recordGraph(caller, roots, time.Since(began))
+			}()
+		}
+	}
+	keepGoing := keepGoingFromContext(ctx)
+	report := reportFromContext(ctx)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	workerCtx := context.WithValue(ctx, _SLOT_CONTEXT_KEY, p)
+
+	nodes := schedule(roots...)
+	prioritize(nodes, historyFromContext(ctx))
+	slog.Debug("scheduling tasks", slog.Int("roots", len(roots)), slog.Int("tasks", len(nodes)), slog.Int("jobs", cap(p.slots)))
+	ready := []*scheduledTask{}
+	for _, node := range nodes {
+		if node.pending == 0 {
+			ready = append(ready, node)
+		}
+	}
+	results := make(chan taskResult)
+	running := 0
+	started := map[*scheduledTask]bool{}
+	var failure *taskResult
+	failures := 0
+	var interrupted error
+	stopped := func() bool {
+		return interrupted != nil || (failure != nil && !keepGoing)
+	}
+
+	for (len(ready) > 0 && !stopped()) || running > 0 {
+		var slots chan struct{}
+		var canceled <-chan struct{}
+		if !stopped() {
+			canceled = ctx.Done()
+			if len(ready) > 0 {
+				slots = p.slots
+			}
+		}
+		select {
+		case <-canceled:
+			interrupted = context.Cause(ctx)
+		case slots <- struct{}{}:
+			next := 0
+			for i, node := range ready {
+				if node.before(ready[next]) {
+					next = i
+				}
+			}
+			node := ready[next]
+			ready = append(ready[:next], ready[next+1:]...)
+			started[node] = true
+			running++
+			go func() {
+				err := node.task.runOnce(workerCtx, p)
+				// the slot is only given back once the result is in, so
+				// with a single job tasks always start in order
+				results <- taskResult{node: node, err: err}
+				p.release()
+			}()
+		case res := <-results:
+			running--
+			if res.err != nil && res.node.task.allowsFailure() {
+				slog.Warn("task failed but is allowed to fail", slog.String("task_id", res.node.task.ID), slog.String("error", res.err.Error()))
+				report.allow(res.node.task.ID, res.err)
+			} else if res.err != nil {
+				if stopped() {
+					// the task was most likely cancelled because of an
+					// earlier failure, that one is what gets reported
+					continue
+				}
+				slog.Warn("task failed to execute", slog.String("task_id", res.node.task.ID), slog.String("error", res.err.Error()))
+				report.fail(res.node.task.ID, res.err)
+				failures++
+				if failure == nil {
+					failure = &res
+				}
+				if !keepGoing {
+					cancel(res.err)
+				}
+				continue
+			}
+			for _, dependent := range res.node.dependents {
+				dependent.pending--
+				if dependent.pending == 0 {
+					ready = append(ready, dependent)
+				}
+			}
+		}
+	}
+	if failure == nil && interrupted == nil {
+		return nil
+	}
+	for _, node := range nodes {
+		if !started[node] {
+			report.skip(node.task.ID)
+		}
+	}
+	if failure == nil {
+		return interrupted
+	}
+	if failures > 1 {
+		return errors.Wrapf(failure.err, "%d tasks failed, the first was %s", failures, failure.node.task.ID)
+	}
+	if slices.Contains(roots, failure.node.task) {
+		return failure.err
+	}
+	if len(roots) > 1 {
+		return errors.Wrapf(failure.err, "%s failed", failure.node.task.ID)
+	}
+	return errors.Wrapf(failure.err, "dependency %s of %s failed", failure.node.task.ID, roots[0].ID)
+}
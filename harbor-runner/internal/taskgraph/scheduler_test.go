@@ -0,0 +1,288 @@
+package taskgraph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingExecutor counts how often each kind runs and how many run at once.
+type countingExecutor struct {
+	mu      sync.Mutex
+	runs    map[string]int
+	running atomic.Int32
+	peak    atomic.Int32
+}
+
+func (c *countingExecutor) Execute(ctx context.Context, kind string, opts json.RawMessage) error {
+	now := c.running.Add(1)
+	defer c.running.Add(-1)
+	for {
+		peak := c.peak.Load()
+		if now <= peak || c.peak.CompareAndSwap(peak, now) {
+			break
+		}
+	}
+	c.mu.Lock()
+	c.runs[kind]++
+	c.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	return nil
+}
+
+// wideDiamond creates a root depending on width tasks that all depend on one
+// shared task.
+func wideDiamond(executor Executor, width int) (*Task, *Task) {
+	shared := &Task{
+		ID:       "shared",
+		Kind:     "shared",
+		executor: executor,
+	}
+	root := &Task{
+		ID:       "root",
+		Kind:     "root",
+		executor: executor,
+	}
+	for i := 0; i < width; i++ {
+		root.Dependencies = append(root.Dependencies, &Task{
+			ID:           fmt.Sprintf("middle-%d", i),
+			Kind:         fmt.Sprintf("middle-%d", i),
+			executor:     executor,
+			Dependencies: []*Task{shared},
+		})
+	}
+	return root, shared
+}
+
+func TestSchedulerRunsEveryTaskOnceWithinJobs(t *testing.T) {
+	assert := assert.New(t)
+	executor := &countingExecutor{runs: map[string]int{}}
+	root, _ := wideDiamond(executor, 12)
+
+	ctx := WithJobs(cfg.ConfigureContext(context.Background()), 3)
+	assert.NoError(root.Execute(ctx))
+	assert.Len(executor.runs, 14)
+	for kind, runs := range executor.runs {
+		assert.Equal(1, runs, kind)
+	}
+	assert.LessOrEqual(executor.peak.Load(), int32(3))
+	assert.Greater(executor.peak.Load(), int32(1))
+}
+
+func TestSchedulerSharesTasksBetweenConcurrentRuns(t *testing.T) {
+	assert := assert.New(t)
+	executor := &countingExecutor{runs: map[string]int{}}
+	first, shared := wideDiamond(executor, 4)
+	second := &Task{
+		ID:           "second",
+		Kind:         "second",
+		executor:     executor,
+		Dependencies: []*Task{shared},
+	}
+
+	ctx := WithJobs(cfg.ConfigureContext(context.Background()), 1)
+	wg := sync.WaitGroup{}
+	for _, root := range []*Task{first, second} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(root.Execute(ctx))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(1, executor.runs["shared"])
+	assert.Equal(1, executor.runs["second"])
+	assert.Equal(1, executor.runs["root"])
+}
+
+// failingGraph creates a root needing a passing task and a task that needs the
+// failing one.
+func failingGraph(executor Executor, failingOptions string) *Task {
+	failing := &Task{ID: "pkg/fails", Kind: "blow_up", Options: json.RawMessage(failingOptions), executor: executor}
+	return &Task{
+		ID:       "pkg/all",
+		Kind:     "all",
+		executor: executor,
+		Dependencies: []*Task{
+			{ID: "pkg/passes", Kind: "passes", executor: executor},
+			{ID: "pkg/needs-fails", Kind: "needs_fails", executor: executor, Dependencies: []*Task{failing}},
+			{ID: "pkg/fails-too", Kind: "blow_up", executor: executor},
+		},
+	}
+}
+
+func TestKeepGoingRunsEveryIndependentTask(t *testing.T) {
+	assert := assert.New(t)
+	executor := &MockExecutor{
+		mockFunc: func(kind string) error {
+			if kind == "blow_up" {
+				return errors.New("boom")
+			}
+			return nil
+		},
+	}
+	ctx, report := WithReport(WithJobs(cfg.ConfigureContext(context.Background()), 1))
+	err := failingGraph(executor, `{}`).Execute(WithKeepGoing(ctx, true))
+	assert.ErrorContains(err, "2 tasks failed, the first was pkg/fails")
+	assert.Equal([]string{"passes", "blow_up", "blow_up"}, executor.executionOrder)
+	assert.Equal([]string{"pkg/fails", "pkg/fails-too"}, []string{report.Failed[0].ID, report.Failed[1].ID})
+	assert.Equal([]string{"pkg/needs-fails", "pkg/all"}, report.Skipped)
+
+	out := &strings.Builder{}
+	assert.NoError(report.Write(out))
+	assert.Contains(out.String(), "2 tasks failed:\n  pkg/fails: ")
+	assert.Contains(out.String(), "2 tasks did not run: pkg/needs-fails, pkg/all")
+}
+
+func TestAllowedFailuresDoNotFailTheRun(t *testing.T) {
+	assert := assert.New(t)
+	executor := &MockExecutor{
+		mockFunc: func(kind string) error {
+			if kind == "blow_up" {
+				return errors.New("boom")
+			}
+			return nil
+		},
+	}
+	root := failingGraph(executor, `{"allowFailure": true}`)
+	root.Dependencies = root.Dependencies[:2]
+	ctx, report := WithReport(WithJobs(cfg.ConfigureContext(context.Background()), 1))
+	assert.NoError(root.Execute(ctx))
+	assert.Equal([]string{"passes", "blow_up", "needs_fails", "all"}, executor.executionOrder)
+	assert.Empty(report.Failed)
+	assert.Equal("pkg/fails", report.Allowed[0].ID)
+	assert.False(report.Empty())
+
+	_, skipped := WithReport(context.Background())
+	assert.True(skipped.Empty())
+	skipped.skip("pkg/interrupted")
+	assert.False(skipped.Empty())
+}
+
+func TestTimingsFindTheSlowestChain(t *testing.T) {
+	assert := assert.New(t)
+	executor := &MockExecutor{
+		mockFunc: func(kind string) error {
+			if kind == "slow" {
+				time.Sleep(40 * time.Millisecond)
+			}
+			return nil
+		},
+	}
+	first := &Task{ID: "first", Kind: "first", executor: executor}
+	slow := &Task{ID: "slow", Kind: "slow", executor: executor, Dependencies: []*Task{first}}
+	fast := &Task{ID: "fast", Kind: "fast", executor: executor, Dependencies: []*Task{first}}
+	last := &Task{ID: "last", Kind: "last", executor: executor, Dependencies: []*Task{fast, slow}}
+
+	ctx, timings := WithTimings(WithJobs(cfg.ConfigureContext(context.Background()), 2))
+	assert.NoError(last.Execute(ctx))
+
+	summary := timings.Summary()
+	assert.Equal(4, summary.Tasks)
+	ids := []string{}
+	for _, timing := range summary.CriticalPath {
+		ids = append(ids, timing.ID)
+	}
+	assert.Equal([]string{"first", "slow", "last"}, ids)
+	assert.GreaterOrEqual(summary.CriticalPathDuration, 40*time.Millisecond)
+	assert.LessOrEqual(summary.CriticalPathDuration, summary.Wall)
+
+	b := &strings.Builder{}
+	assert.NoError(summary.Write(b))
+	assert.Contains(b.String(), "4 tasks in ")
+	assert.Contains(b.String(), "slowest chain")
+}
+
+func TestTasksSharingALockNeverOverlap(t *testing.T) {
+	assert := assert.New(t)
+	withLocks := func(executor Executor, locks string) *Task {
+		root := &Task{ID: "root", Kind: "root", executor: executor}
+		for i := 0; i < 6; i++ {
+			root.Dependencies = append(root.Dependencies, &Task{
+				ID:       fmt.Sprintf("integration-%d", i),
+				Kind:     fmt.Sprintf("integration-%d", i),
+				Options:  json.RawMessage(fmt.Sprintf(`{"locks": %s}`, locks)),
+				executor: executor,
+			})
+		}
+		return root
+	}
+
+	executor := &countingExecutor{runs: map[string]int{}}
+	ctx := WithJobs(cfg.ConfigureContext(context.Background()), 4)
+	assert.NoError(withLocks(executor, `["port-8080"]`).Execute(ctx))
+	assert.Equal(int32(1), executor.peak.Load())
+	assert.Len(executor.runs, 7)
+
+	heavy := *cfg
+	heavy.Resources = map[string]int{"heavy": 2}
+	executor = &countingExecutor{runs: map[string]int{}}
+	ctx = WithJobs(heavy.ConfigureContext(context.Background()), 4)
+	assert.NoError(withLocks(executor, `["heavy"]`).Execute(ctx))
+	assert.Equal(int32(2), executor.peak.Load())
+
+	executor = &countingExecutor{runs: map[string]int{}}
+	err := withLocks(executor, `[{"name": "heavy", "weight": 3}]`).Execute(ctx)
+	assert.ErrorContains(err, "needs 3 of heavy, which only has 2")
+}
+
+func TestReadyTasksStartByPriorityThenLongestChain(t *testing.T) {
+	assert := assert.New(t)
+	executor := &MockExecutor{}
+	lint := &Task{ID: "lint", Kind: "lint", executor: executor}
+	docs := &Task{ID: "docs", Kind: "docs", executor: executor}
+	compile := &Task{ID: "compile", Kind: "compile", executor: executor}
+	e2e := &Task{ID: "e2e", Kind: "e2e", executor: executor, Dependencies: []*Task{compile}}
+	urgent := &Task{ID: "urgent", Kind: "urgent", Options: json.RawMessage(`{"priority": 10}`), executor: executor}
+	root := &Task{ID: "root", Kind: "root", executor: executor, Dependencies: []*Task{lint, docs, e2e, urgent}}
+
+	history := LoadHistory(filepath.Join(t.TempDir(), "history.json"))
+	ctx, timings := WithTimings(context.Background())
+	timings.record(docs, time.Unix(0, 0), time.Unix(2, 0), false, false)
+	timings.record(compile, time.Unix(0, 0), time.Unix(1, 0), false, false)
+	timings.record(e2e, time.Unix(1, 0), time.Unix(4, 0), false, false)
+	history.Record(timings)
+	assert.NoError(history.Save())
+	history = LoadHistory(history.path)
+	assert.Equal(3*time.Second, history.expected("e2e"))
+
+	ctx = WithHistory(WithJobs(cfg.ConfigureContext(ctx), 1), history)
+	assert.NoError(root.Execute(ctx))
+	assert.Equal([]string{"urgent", "compile", "e2e", "docs", "lint", "root"}, executor.executionOrder)
+}
+
+// replayingExecutor replays every task from the cache.
+type replayingExecutor struct{}
+
+func (replayingExecutor) Execute(ctx context.Context, kind string, opts json.RawMessage) error {
+	MarkReplayed(ctx)
+	return nil
+}
+
+func TestReplayedTasksKeepTheirExpectedDuration(t *testing.T) {
+	assert := assert.New(t)
+	build := &Task{ID: "build", Kind: "build"}
+	history := LoadHistory(filepath.Join(t.TempDir(), "history.json"))
+	_, timings := WithTimings(context.Background())
+	timings.record(build, time.Unix(0, 0), time.Unix(600, 0), false, false)
+	history.Record(timings)
+
+	for i := 0; i < 2; i++ {
+		// every run starts from a fresh tree
+		build := &Task{ID: "build", Kind: "build", executor: replayingExecutor{}}
+		ctx, timings := WithTimings(cfg.ConfigureContext(context.Background()))
+		assert.NoError(build.Execute(ctx))
+		assert.True(timings.Summary().CriticalPath[0].Replayed)
+		history.Record(timings)
+	}
+	assert.Equal(10*time.Minute, history.expected("build"))
+}
@@ -0,0 +1,86 @@
+package taskgraph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const maxSuggestions = 3
+
+// UnknownTasksError lists task names that are not registered, along with the
+// registered names they were most likely meant to be.
+type UnknownTasksError struct {
+	Names       []string
+	Suggestions map[string][]string
+	Registered  []string
+}
+
+func (e *UnknownTasksError) Error() string {
+	unknown := []string{}
+	for _, name := range e.Names {
+		if suggestions := e.Suggestions[name]; len(suggestions) > 0 {
+			unknown = append(unknown, fmt.Sprintf("%s (did you mean %s?)", name, strings.Join(suggestions, " or ")))
+		} else {
+			unknown = append(unknown, name)
+		}
+	}
+	msg := fmt.Sprintf("unknown task %s", unknown[0])
+	if len(unknown) > 1 {
+		msg = fmt.Sprintf("unknown tasks %s", strings.Join(unknown, ", "))
+	}
+	if len(e.Registered) == 0 {
+		return msg + ", the package has no registered tasks"
+	}
+	return fmt.Sprintf("%s, registered tasks are %s", msg, strings.Join(e.Registered, ", "))
+}
+
+// suggest returns the candidates that look most like name, either because they
+// are a few edits away or because they contain it.
+func suggest(name string, candidates []string) []string {
+	type match struct {
+		name     string
+		distance int
+	}
+	matches := []match{}
+	lower := strings.ToLower(name)
+	for _, candidate := range candidates {
+		distance := editDistance(lower, strings.ToLower(candidate))
+		if distance <= max(2, len(name)/3) || strings.Contains(strings.ToLower(candidate), lower) {
+			matches = append(matches, match{name: candidate, distance: distance})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].name < matches[j].name
+	})
+	suggestions := []string{}
+	for i := 0; i < len(matches) && i < maxSuggestions; i++ {
+		suggestions = append(suggestions, matches[i].name)
+	}
+	return suggestions
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
@@ -5,7 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
-	"sync"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 	"github.com/radding/harbor-runner/internal/cache"
@@ -25,6 +25,26 @@ func GetTaskFromContext(ctx context.Context) (Task, error) {
 	return *t, nil
 }
 
+const _KEY_INPUTS_CONTEXT_KEY = taskContextKeyType("KEY_INPUTS")
+
+// GetKeyInputsFromContext returns what went into the cache key of the task
+// being executed.
+func GetKeyInputsFromContext(ctx context.Context) (*KeyInputs, bool) {
+	inputs, ok := ctx.Value(_KEY_INPUTS_CONTEXT_KEY).(*KeyInputs)
+	return inputs, ok
+}
+
+const _REPLAYED_CONTEXT_KEY = taskContextKeyType("REPLAYED")
+
+// MarkReplayed tells the scheduler that the task being executed was replayed
+// from the cache instead of running, so how long it took says nothing about
+// how long the task takes.
+func MarkReplayed(ctx context.Context) {
+	if replayed, ok := ctx.Value(_REPLAYED_CONTEXT_KEY).(*atomic.Bool); ok {
+		replayed.Store(true)
+	}
+}
+
 type Executor interface {
 	Execute(ctx context.Context, kind string, opts json.RawMessage) error
 }
@@ -36,8 +56,7 @@ type Task struct {
 	Dependencies  []*Task
 	dependencySet map[string]bool
 	executor      Executor
-	done          bool
-	err           error
+	state         *taskState
 }
 
 func (t *Task) GetExecutor() Executor {
@@ -52,73 +71,48 @@ func (t *Task) addDependency(t2 *Task) {
 	t.Dependencies = append(t.Dependencies, t2)
 }
 
-func (t *Task) Execute(ctx context.Context) error {
+// prepare adds everything the executor needs to run the task to ctx: the task
+// itself, its cache key inputs and its cache.
+func (t *Task) prepare(ctx context.Context) (context.Context, error) {
+	cfg, err := packageconfig.ExtractConfigFromContext(ctx)
+	if err != nil {
+		return ctx, errors.Wrap(err, "could not get config from context")
+	}
+	ctx = context.WithValue(ctx, _TASK_CONTEXT_KEY, t)
+	key, err := t.CacheKey(ctx)
+	if err != nil {
+		return ctx, errors.Wrap(err, "failed to compute cache key")
+	}
+	keyInputs, err := t.CacheKeyInputs(ctx)
+	if err != nil {
+		return ctx, errors.Wrap(err, "failed to compute cache key")
+	}
+	cacheObj, err := cfg.GetTaskCache().GetSubCache(t.ID)
+	if err != nil {
+		return ctx, errors.Wrap(err, "failed to get sub cache")
+	}
+	cacheObj, err = cacheObj.GetSubCache(key)
+	if err != nil {
+		return ctx, errors.Wrap(err, "failed to get sub cache for key")
+	}
+	slog.Debug("computed cache key", slog.String("task_id", t.ID), slog.String("key", key))
+	ctx = context.WithValue(ctx, cache.CacheContextKeyValue, cacheObj)
+	ctx = context.WithValue(ctx, _KEY_INPUTS_CONTEXT_KEY, keyInputs)
+	return ctx, nil
+}
+
+// run executes the task itself, its dependencies must already have run.
+func (t *Task) run(ctx context.Context) error {
 	return telemetry.TimeWithError(fmt.Sprintf("executing task %s", t.ID), func() error {
 		slog.Debug("Executing task", slog.String("task_id", t.ID))
-		cfg, err := packageconfig.ExtractConfigFromContext(ctx)
-		if err != nil {
-			return errors.Wrap(err, "could not get config from context")
-		}
-		cacheObj, err := cfg.GetCache().GetSubCache(t.ID)
+		ctx, err := t.prepare(ctx)
 		if err != nil {
-			return errors.Wrap(err, "failed to get sub cache")
-		}
-		if t.done {
-			slog.Debug("Task has already been done durring this run, returning early")
-			return t.err
-		}
-		ctx = context.WithValue(ctx, _TASK_CONTEXT_KEY, t)
-		ctx = context.WithValue(ctx, cache.CacheContextKeyValue, cacheObj)
-		ctx, cancel := context.WithCancelCause(ctx)
-		err = t.executeChildren(ctx)
-		if err != nil {
-			cancel(err)
-			slog.Warn("task's children failed to execute", slog.String("task_id", t.ID), slog.String("error", err.Error()))
-			t.done = true
-
-			t.err = errors.Wrap(err, "failed to execute children")
-			return t.err
+			return err
 		}
-		err = t.executor.Execute(ctx, t.Kind, t.Options)
+		err = t.execute(ctx)
 		if err != nil {
-			slog.Warn("task failed to execute", slog.String("task_id", t.ID), slog.String("error", err.Error()))
-			cancel(err)
-			t.done = true
-			t.err = errors.Wrap(err, "failed to execute task")
-			return t.err
+			return errors.Wrap(err, "failed to execute task")
 		}
-		t.done = true
 		return nil
 	})
 }
-
-func (t *Task) executeChildren(ctx context.Context) error {
-	ctx, cancel := context.WithCancelCause(ctx)
-	waitCh := make(chan struct{})
-	go func() {
-		wg := &sync.WaitGroup{}
-		for _, dep := range t.Dependencies {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				err := dep.Execute(ctx)
-				if err != nil {
-					telemetry.Trace("child died", slog.String("child_id", dep.ID), slog.String("task_id", dep.ID), slog.String("error", err.Error()))
-					cancel(err)
-				}
-			}()
-		}
-		wg.Wait()
-		waitCh <- struct{}{}
-	}()
-
-	select {
-	case <-ctx.Done():
-		telemetry.Trace("Damn, someone failed :(")
-		return ctx.Err()
-	case <-waitCh:
-		close(waitCh)
-		telemetry.Trace("finished executing all children")
-		return nil
-	}
-}
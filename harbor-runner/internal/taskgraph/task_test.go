@@ -4,18 +4,22 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 type MockExecutor struct {
+	mu             sync.Mutex
 	executionOrder []string
 	mockFunc       func(kind string) error
 }
 
 func (m *MockExecutor) Execute(ctx context.Context, kind string, opts json.RawMessage) error {
+	m.mu.Lock()
 	m.executionOrder = append(m.executionOrder, kind)
+	m.mu.Unlock()
 	if m.mockFunc != nil {
 		return m.mockFunc(kind)
 	}
@@ -44,7 +48,7 @@ func TestExecutionOrder(t *testing.T) {
 		Kind:         "test4",
 		Dependencies: []*Task{task3, task1},
 	}
-	ctx := cfg.ConfigureContext(context.Background())
+	ctx := WithJobs(cfg.ConfigureContext(context.Background()), 1)
 	err := rootTask.Execute(ctx)
 	assert.NoError(err)
 	assert.Equal([]string{"test1", "test2", "test3", "test4"}, executor.executionOrder)
@@ -85,7 +89,7 @@ func TestErrorCancelsEverything(t *testing.T) {
 		Kind:         "test4",
 		Dependencies: []*Task{task3, task1},
 	}
-	ctx := cfg.ConfigureContext(context.Background())
+	ctx := WithJobs(cfg.ConfigureContext(context.Background()), 1)
 	err := rootTask.Execute(ctx)
 	assert.Error(err)
 	assert.Equal([]string{"test1", "test2", "blow_up"}, executor.executionOrder)
@@ -0,0 +1,195 @@
+package taskgraph
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const _TIMINGS_CONTEXT_KEY = schedulerContextKeyType("TIMINGS")
+
+// TaskTiming is when a task of a run ran.
+type TaskTiming struct {
+	ID    string
+	Start time.Time
+	End   time.Time
+	// Waited is the part of the task's time spent waiting for the task graphs
+	// it ran, like the tasks of a local dependency. Those tasks are timed on
+	// their own.
+	Waited time.Duration
+	// Replayed and Failed are set for tasks that were replayed from the cache
+	// or failed, their duration isn't how long the task takes.
+	Replayed bool
+	Failed   bool
+}
+
+// Duration is how long the task itself took.
+func (t TaskTiming) Duration() time.Duration {
+	return t.End.Sub(t.Start) - t.Waited
+}
+
+// Timings collects when every task of a run ran, across every task graph the
+// run executes.
+type Timings struct {
+	mu    sync.Mutex
+	tasks map[*Task]*TaskTiming
+	// ran are the roots of the task graphs a task ran.
+	ran   map[*Task][]*Task
+	order []*Task
+}
+
+// WithTimings adds timings to ctx that every task graph executed with it
+// records its tasks in.
+func WithTimings(ctx context.Context) (context.Context, *Timings) {
+	timings := &Timings{
+		tasks: map[*Task]*TaskTiming{},
+		ran:   map[*Task][]*Task{},
+	}
+	return context.WithValue(ctx, _TIMINGS_CONTEXT_KEY, timings), timings
+}
+
+func timingsFromContext(ctx context.Context) (*Timings, bool) {
+	timings, ok := ctx.Value(_TIMINGS_CONTEXT_KEY).(*Timings)
+	return timings, ok
+}
+
+func (t *Timings) record(task *Task, start, end time.Time, replayed, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timing, ok := t.tasks[task]
+	if !ok {
+		timing = &TaskTiming{ID: task.ID}
+		t.tasks[task] = timing
+		t.order = append(t.order, task)
+	}
+	timing.Start = start
+	timing.End = end
+	timing.Replayed = replayed
+	timing.Failed = failed
+}
+
+// recordGraph notes that caller waited for the task graph below roots.
+func (t *Timings) recordGraph(caller *Task, roots []*Task, waited time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timing, ok := t.tasks[caller]
+	if !ok {
+		timing = &TaskTiming{ID: caller.ID}
+		t.tasks[caller] = timing
+		t.order = append(t.order, caller)
+	}
+	timing.Waited += waited
+	t.ran[caller] = append(t.ran[caller], roots...)
+}
+
+// timed returns the timings of the tasks that ran.
+func (t *Timings) timed() []TaskTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timed := []TaskTiming{}
+	for _, task := range t.order {
+		if timing := t.tasks[task]; !timing.Start.IsZero() {
+			timed = append(timed, *timing)
+		}
+	}
+	return timed
+}
+
+// TimingSummary sums up where the time of a run went.
+type TimingSummary struct {
+	Tasks int
+	// Wall is the time from the first task starting to the last one ending.
+	Wall time.Duration
+	// Busy is the time of every task added up.
+	Busy time.Duration
+	// CriticalPath is the chain of tasks, each needing the one before it,
+	// that took the longest. The run could not have been shorter than it.
+	CriticalPath         []TaskTiming
+	CriticalPathDuration time.Duration
+}
+
+// Parallelism is how many tasks ran at the same time on average.
+func (s TimingSummary) Parallelism() float64 {
+	if s.Wall <= 0 {
+		return 0
+	}
+	return float64(s.Busy) / float64(s.Wall)
+}
+
+// Summary sums up the tasks timed so far.
+func (t *Timings) Summary() TimingSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	summary := TimingSummary{}
+	var first, last time.Time
+	for _, task := range t.order {
+		timing := t.tasks[task]
+		if timing.Start.IsZero() {
+			continue
+		}
+		summary.Tasks++
+		summary.Busy += timing.Duration()
+		if first.IsZero() || timing.Start.Before(first) {
+			first = timing.Start
+		}
+		if timing.End.After(last) {
+			last = timing.End
+		}
+	}
+	summary.Wall = last.Sub(first)
+
+	// longest is how long the slowest chain of timed tasks ending with a
+	// task took, before is the task that chain came from.
+	longest := map[*Task]time.Duration{}
+	before := map[*Task]*Task{}
+	var chain func(task *Task) time.Duration
+	chain = func(task *Task) time.Duration {
+		if d, ok := longest[task]; ok {
+			return d
+		}
+		longest[task] = 0
+		var slowest time.Duration
+		for _, need := range append(append([]*Task{}, task.Dependencies...), t.ran[task]...) {
+			if timing, ok := t.tasks[need]; !ok || timing.Start.IsZero() {
+				continue
+			}
+			if d := chain(need); before[task] == nil || d > slowest {
+				slowest = d
+				before[task] = need
+			}
+		}
+		longest[task] = slowest + t.tasks[task].Duration()
+		return longest[task]
+	}
+	var end *Task
+	for _, task := range t.order {
+		if t.tasks[task].Start.IsZero() {
+			continue
+		}
+		if d := chain(task); end == nil || d > summary.CriticalPathDuration {
+			end = task
+			summary.CriticalPathDuration = d
+		}
+	}
+	for task := end; task != nil; task = before[task] {
+		summary.CriticalPath = append([]TaskTiming{*t.tasks[task]}, summary.CriticalPath...)
+	}
+	return summary
+}
+
+// Write prints the summary.
+func (s TimingSummary) Write(w io.Writer) error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s in %s, %s of task time, %.1f tasks in parallel on average\n", plural(s.Tasks, "task", "tasks"), s.Wall.Round(time.Millisecond), s.Busy.Round(time.Millisecond), s.Parallelism())
+	if len(s.CriticalPath) > 0 {
+		fmt.Fprintf(b, "slowest chain, %s:\n", s.CriticalPathDuration.Round(time.Millisecond))
+		for _, timing := range s.CriticalPath {
+			fmt.Fprintf(b, "  %-10s %s\n", timing.Duration().Round(time.Millisecond), timing.ID)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}